@@ -0,0 +1,16 @@
+package main
+
+import (
+	cdshim "github.com/containerd/containerd/runtime/v2/shim"
+	"github.com/rorym/dock-fire/internal/shim"
+)
+
+func main() {
+	cdshim.Run(shim.RuntimeName, shim.New, func(c *cdshim.Config) {
+		// The shim waits on Firecracker and the tools that build the VM
+		// itself; a shim-wide reaper would race those waits for exit
+		// statuses.
+		c.NoReaper = true
+		c.NoSubreaper = true
+	})
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/oci"
+	"golang.org/x/sys/unix"
+)
+
+// serveAgent listens on the vsock agent port and handles requests from the
+// host runtime for the lifetime of the VM. defaultEnv is used for exec
+// requests that don't carry their own environment.
+func serveAgent(defaultEnv []string) error {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("vsock socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: agent.Port}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("vsock bind: %w", err)
+	}
+	if err := unix.Listen(fd, 16); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("vsock listen: %w", err)
+	}
+
+	go func() {
+		for {
+			nfd, _, err := unix.Accept4(fd, unix.SOCK_CLOEXEC)
+			if err != nil {
+				if err == unix.EINTR || err == unix.ECONNABORTED {
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "dock-fire-init: agent accept: %v\n", err)
+				return
+			}
+			go handleConn(os.NewFile(uintptr(nfd), "vsock"), defaultEnv)
+		}
+	}()
+	return nil
+}
+
+// exitDeliveryTimeout bounds how long init holds the VM up after the main
+// process exits, waiting for the host to collect its exit status.
+const exitDeliveryTimeout = 5 * time.Second
+
+// mainProcess tracks the container's main process for wait requests.
+var mainProcess = newWorkload()
+
+// workload gates the start of a process on the host's start request and
+// records its exit status so it can be handed to the host before the VM
+// shuts down.
+type workload struct {
+	mu          sync.Mutex
+	pid         int
+	status      agent.ExitStatus
+	released    chan struct{}
+	releaseOnce sync.Once
+	launched    chan struct{}
+	exited      chan struct{}
+	exitOnce    sync.Once
+	delivered   chan struct{}
+	delivOnce   sync.Once
+}
+
+func newWorkload() *workload {
+	return &workload{
+		released:  make(chan struct{}),
+		launched:  make(chan struct{}),
+		exited:    make(chan struct{}),
+		delivered: make(chan struct{}),
+	}
+}
+
+// release lets the process start. Safe to call more than once.
+func (w *workload) release() {
+	w.releaseOnce.Do(func() { close(w.released) })
+}
+
+// waitRelease blocks until release is called.
+func (w *workload) waitRelease() {
+	<-w.released
+}
+
+func (w *workload) started(pid int) {
+	w.mu.Lock()
+	w.pid = pid
+	w.mu.Unlock()
+	close(w.launched)
+}
+
+func (w *workload) exit(status agent.ExitStatus) {
+	w.exitOnce.Do(func() {
+		w.mu.Lock()
+		w.status = status
+		w.mu.Unlock()
+		close(w.exited)
+	})
+}
+
+// waitDelivered blocks until a waiter has received the exit status or the
+// timeout expires.
+func (w *workload) waitDelivered(timeout time.Duration) {
+	select {
+	case <-w.delivered:
+	case <-time.After(timeout):
+	}
+}
+
+func handleConn(conn *os.File, defaultEnv []string) {
+	defer conn.Close()
+
+	var req agent.Request
+	if err := agent.ReadMessage(conn, &req); err != nil {
+		return
+	}
+
+	switch req.Type {
+	case agent.RequestExec:
+		if req.Process == nil || len(req.Process.Args) == 0 {
+			agent.WriteJSON(conn, agent.FrameMessage, agent.Response{Error: "no process specified"})
+			return
+		}
+		handleExec(conn, req.Process, defaultEnv)
+	case agent.RequestStart:
+		handleStart(conn, mainProcess)
+	case agent.RequestPs:
+		procs, err := listProcesses()
+		resp := agent.Response{Processes: procs}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		agent.WriteJSON(conn, agent.FrameMessage, resp)
+	case agent.RequestStats:
+		stats, err := guestStats()
+		resp := agent.Response{Stats: stats}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		agent.WriteJSON(conn, agent.FrameMessage, resp)
+	case agent.RequestSignal:
+		handleSignal(conn, mainProcess, req.Signal, req.PID, req.All)
+	case agent.RequestWait:
+		handleWait(conn, mainProcess, req.Stdio)
+	case agent.RequestHooks:
+		resp := agent.Response{}
+		if err := oci.RunHooks(req.Hook, req.Hooks, req.State); err != nil {
+			resp.Error = err.Error()
+		}
+		agent.WriteJSON(conn, agent.FrameMessage, resp)
+	case agent.RequestNetwork:
+		resp := agent.Response{}
+		if err := setAddress("eth0", req.Address, req.Gateway); err != nil {
+			resp.Error = err.Error()
+		}
+		agent.WriteJSON(conn, agent.FrameMessage, resp)
+	default:
+		agent.WriteJSON(conn, agent.FrameMessage, agent.Response{Error: fmt.Sprintf("unknown request type %q", req.Type)})
+	}
+}
+
+// handleExec starts proc and relays its stdio over conn until it exits.
+func handleExec(conn *os.File, proc *agent.Process, defaultEnv []string) {
+	fw := agent.NewFrameWriter(conn)
+	reply := func(resp agent.Response) {
+		fw.WriteJSON(agent.FrameMessage, resp)
+	}
+
+	env := proc.Env
+	if len(env) == 0 {
+		env = defaultEnv
+	}
+	env = withHome(env, proc.User.UID)
+	binary, err := lookPath(proc.Args[0], env)
+	if err != nil {
+		reply(agent.Response{Error: fmt.Sprintf("resolve command %q: %v", proc.Args[0], err)})
+		return
+	}
+
+	cmd := exec.Command(binary, proc.Args[1:]...)
+	cmd.Env = env
+	cmd.Dir = proc.Cwd
+
+	// stdin is written from frames; output is read back and framed.
+	// Everything the child holds is closed in the parent after Start.
+	var (
+		stdin   io.WriteCloser
+		outputs []io.Reader
+		streams []byte
+		closers []io.Closer
+		master  *os.File
+	)
+	if proc.Terminal {
+		m, slave, err := openPTY()
+		if err != nil {
+			reply(agent.Response{Error: err.Error()})
+			return
+		}
+		master = m
+		defer master.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		closers = append(closers, slave)
+		stdin = master
+		outputs = []io.Reader{master}
+		streams = []byte{agent.FrameStdout}
+	} else {
+		inR, inW, err := os.Pipe()
+		if err != nil {
+			reply(agent.Response{Error: err.Error()})
+			return
+		}
+		outR, outW, err := os.Pipe()
+		if err != nil {
+			inR.Close()
+			inW.Close()
+			reply(agent.Response{Error: err.Error()})
+			return
+		}
+		errR, errW, err := os.Pipe()
+		if err != nil {
+			inR.Close()
+			inW.Close()
+			outR.Close()
+			outW.Close()
+			reply(agent.Response{Error: err.Error()})
+			return
+		}
+		defer inW.Close()
+		defer outR.Close()
+		defer errR.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, errW
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		closers = append(closers, inR, outW, errW)
+		stdin = inW
+		outputs = []io.Reader{outR, errR}
+		streams = []byte{agent.FrameStdout, agent.FrameStderr}
+	}
+
+	err = startAs(cmd, proc.User)
+	for _, c := range closers {
+		c.Close()
+	}
+	if err != nil {
+		reply(agent.Response{Error: fmt.Sprintf("start command: %v", err)})
+		return
+	}
+	reply(agent.Response{PID: cmd.Process.Pid})
+
+	var pumps sync.WaitGroup
+	for i, r := range outputs {
+		pumps.Add(1)
+		go func(r io.Reader, typ byte) {
+			defer pumps.Done()
+			io.Copy(fw.Stream(typ), r)
+		}(r, streams[i])
+	}
+
+	go func() {
+		for {
+			typ, payload, err := agent.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			switch typ {
+			case agent.FrameStdin:
+				stdin.Write(payload)
+			case agent.FrameStdinClose:
+				// A terminal stays open, as with runc; only a pipe
+				// passes on the end of input.
+				if master == nil {
+					stdin.Close()
+				}
+			case agent.FrameResize:
+				var size agent.WindowSize
+				if master != nil && json.Unmarshal(payload, &size) == nil {
+					unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: size.Rows, Col: size.Cols})
+				}
+			}
+		}
+	}()
+
+	cmd.Wait()
+	pumps.Wait()
+
+	fw.WriteJSON(agent.FrameExit, exitStatus(cmd.ProcessState))
+}
+
+// handleStart releases w and replies once it is running.
+func handleStart(conn *os.File, w *workload) {
+	w.release()
+	select {
+	case <-w.launched:
+	case <-w.exited:
+	}
+	w.mu.Lock()
+	pid := w.pid
+	w.mu.Unlock()
+	if pid == 0 {
+		agent.WriteJSON(conn, agent.FrameMessage, agent.Response{Error: "main process failed to start"})
+		return
+	}
+	agent.WriteJSON(conn, agent.FrameMessage, agent.Response{PID: pid})
+}
+
+// handleSignal sends sig to w's process group, or to target's when it is
+// non-zero, or to every process in the guest except init when all is set.
+func handleSignal(conn *os.File, w *workload, sig, target int, all bool) {
+	reply := func(err error) {
+		resp := agent.Response{}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		agent.WriteJSON(conn, agent.FrameMessage, resp)
+	}
+
+	if sig <= 0 {
+		reply(fmt.Errorf("invalid signal %d", sig))
+		return
+	}
+	if all {
+		// pid -1 reaches every process we may signal except ourselves
+		if err := unix.Kill(-1, unix.Signal(sig)); err != nil && err != unix.ESRCH {
+			reply(fmt.Errorf("signal all processes: %w", err))
+			return
+		}
+		reply(nil)
+		return
+	}
+
+	pid := target
+	if pid == 0 {
+		w.mu.Lock()
+		pid = w.pid
+		w.mu.Unlock()
+		if pid == 0 {
+			reply(fmt.Errorf("main process is not running"))
+			return
+		}
+	}
+	// The main process and execs lead their own process groups, so this
+	// also reaches children that share them.
+	err := unix.Kill(-pid, unix.Signal(sig))
+	if err == unix.ESRCH {
+		err = unix.Kill(pid, unix.Signal(sig))
+	}
+	if err != nil {
+		reply(fmt.Errorf("signal process %d: %w", pid, err))
+		return
+	}
+	reply(nil)
+}
+
+// handleWait sends w's exit status once it exits. The host closes the
+// connection after reading it, which tells us the status was delivered.
+// With stdio set, the connection also carries w's stdio until then.
+func handleWait(conn *os.File, w *workload, stdio bool) {
+	fw := agent.NewFrameWriter(conn)
+	w.mu.Lock()
+	pid := w.pid
+	w.mu.Unlock()
+	if err := fw.WriteJSON(agent.FrameMessage, agent.Response{PID: pid}); err != nil {
+		return
+	}
+	if stdio {
+		mainIO.attach(fw)
+		defer mainIO.detach(fw)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			typ, payload, err := agent.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			if !stdio {
+				continue
+			}
+			switch typ {
+			case agent.FrameStdin:
+				mainIO.writeStdin(payload)
+			case agent.FrameStdinClose:
+				mainIO.closeStdin()
+			}
+		}
+	}()
+
+	<-w.exited
+	w.mu.Lock()
+	status := w.status
+	w.mu.Unlock()
+	if err := fw.WriteJSON(agent.FrameExit, status); err != nil {
+		return
+	}
+	<-closed
+	w.delivOnce.Do(func() { close(w.delivered) })
+}
+
+// exitStatus converts a finished process's state into an agent.ExitStatus.
+func exitStatus(state *os.ProcessState) agent.ExitStatus {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return agent.ExitStatus{Signal: int(ws.Signal())}
+	}
+	return agent.ExitStatus{Code: state.ExitCode()}
+}
+
+// lookPath resolves file using the PATH from env, falling back to init's own.
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return exec.LookPath(file)
+	}
+	path := os.Getenv("PATH")
+	for _, e := range env {
+		if kv := splitEnvVar(e); kv[0] == "PATH" {
+			path = kv[1]
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		p := filepath.Join(dir, file)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() && fi.Mode()&0o111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable file not found in $PATH")
+}
+
+// openPTY opens a new pseudoterminal pair from the guest's devpts.
+func openPTY() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open /dev/ptmx: %w", err)
+	}
+	ptsNum, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("TIOCGPTN: %w", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("TIOCSPTLCK: %w", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", ptsNum)
+	slave, err = os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("open %s: %w", slavePath, err)
+	}
+	return master, slave, nil
+}
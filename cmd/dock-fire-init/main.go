@@ -2,25 +2,46 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
+
+	"github.com/rorym/dock-fire/internal/agent"
 )
 
 const configPath = "/etc/dock-fire/config.json"
 
 type initConfig struct {
-	Args     []string `json:"args"`
-	Env      []string `json:"env"`
-	Cwd      string   `json:"cwd"`
-	Terminal bool     `json:"terminal,omitempty"`
+	Args     []string     `json:"args"`
+	Env      []string     `json:"env"`
+	Cwd      string       `json:"cwd"`
+	Terminal bool         `json:"terminal,omitempty"`
+	Mounts   []initMount  `json:"mounts,omitempty"`
+	Volumes  []initVolume `json:"volumes,omitempty"`
+	User     agent.User   `json:"user"`
+	// Hostname and Domainname are set in the kernel.
+	Hostname   string `json:"hostname,omitempty"`
+	Domainname string `json:"domainname,omitempty"`
+	// ReadonlyRoot keeps / read-only; writable paths come from Mounts.
+	ReadonlyRoot bool `json:"readonlyRoot,omitempty"`
 }
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "dock-fire-init: %v\n", err)
+		mainIO.reportError(fmt.Sprintf("dock-fire-init: %v\n", err))
+		// Report the failure like a shell would so the host sees a
+		// non-zero exit status rather than a VM that just went away.
+		code := 1
+		if errors.Is(err, exec.ErrNotFound) {
+			code = 127
+		}
+		mainProcess.exit(agent.ExitStatus{Code: code})
+		mainProcess.waitDelivered(exitDeliveryTimeout)
 		reboot()
 	}
 }
@@ -36,6 +57,7 @@ func run() error {
 		{"proc", "/proc", "proc", 0},
 		{"sysfs", "/sys", "sysfs", 0},
 		{"devtmpfs", "/dev", "devtmpfs", 0},
+		{"devpts", "/dev/pts", "devpts", 0},
 	}
 
 	for _, m := range mounts {
@@ -43,11 +65,6 @@ func run() error {
 		syscall.Mount(m.source, m.target, m.fstype, m.flags, "")
 	}
 
-	// Set up DNS if not already configured (Docker creates empty resolv.conf with --net=none)
-	if data, err := os.ReadFile("/etc/resolv.conf"); err != nil || len(data) == 0 {
-		os.WriteFile("/etc/resolv.conf", []byte("nameserver 8.8.8.8\nnameserver 8.8.4.4\n"), 0o644)
-	}
-
 	// Read config
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -62,6 +79,37 @@ func run() error {
 		return fmt.Errorf("no command specified")
 	}
 
+	if cfg.ReadonlyRoot {
+		// Firecracker boots a read-only root drive ro; this is in case
+		// the kernel was told otherwise
+		if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("remount / read-only: %w", err)
+		}
+	}
+	if err := mountAll(cfg.Mounts); err != nil {
+		return err
+	}
+	if err := mountVolumes(cfg.Volumes); err != nil {
+		return err
+	}
+
+	if cfg.Hostname != "" {
+		if err := syscall.Sethostname([]byte(cfg.Hostname)); err != nil {
+			return fmt.Errorf("set hostname: %w", err)
+		}
+	}
+	if cfg.Domainname != "" {
+		if err := syscall.Setdomainname([]byte(cfg.Domainname)); err != nil {
+			return fmt.Errorf("set domainname: %w", err)
+		}
+	}
+
+	// The runtime copies in Docker's resolv.conf. Without one, or without
+	// any nameserver in it, fall back to public DNS.
+	if !hasNameserver("/etc/resolv.conf") {
+		os.WriteFile("/etc/resolv.conf", []byte("nameserver 8.8.8.8\nnameserver 8.8.4.4\n"), 0o644)
+	}
+
 	// Change working directory
 	if cfg.Cwd != "" {
 		if err := os.Chdir(cfg.Cwd); err != nil {
@@ -77,6 +125,7 @@ func run() error {
 			"TERM=xterm",
 		}
 	}
+	env = withHome(env, cfg.User.UID)
 	// Apply env to current process so LookPath works
 	for _, e := range env {
 		parts := splitEnvVar(e)
@@ -85,12 +134,31 @@ func run() error {
 		}
 	}
 
+	// The host relays stdin as soon as it waits on the process, before
+	// start, so the pipe has to be there to hold it
+	if !cfg.Terminal {
+		if err := mainIO.openStdin(); err != nil {
+			return fmt.Errorf("set up stdin: %w", err)
+		}
+	}
+
+	// Start the agent so the host can control the VM. Without it nothing
+	// can release the workload, so run it straight away.
+	if err := serveAgent(env); err != nil {
+		fmt.Fprintf(os.Stderr, "dock-fire-init: agent unavailable: %v\n", err)
+		mainProcess.release()
+	}
+
 	// Resolve the command
 	binary, err := exec.LookPath(cfg.Args[0])
 	if err != nil {
 		return fmt.Errorf("resolve command %q: %w", cfg.Args[0], err)
 	}
 
+	// The guest is ready. Hold the workload until the runtime's start
+	// action so nothing runs before containerd has attached I/O.
+	mainProcess.waitRelease()
+
 	// Set up stdio for the child process.
 	// When terminal mode is requested, open /dev/ttyS0 as a proper
 	// controlling terminal so bash gets job control. /dev/console
@@ -98,6 +166,7 @@ func run() error {
 	// Start the child process
 	cmd := exec.Command(binary, cfg.Args[1:]...)
 	cmd.Env = env
+	closeChildEnds := func() {}
 
 	if cfg.Terminal {
 		// Open /dev/ttyS0 as a proper TTY for the child. /dev/console
@@ -117,34 +186,68 @@ func run() error {
 			Ctty:    0, // fd 0 in the child (stdin = tty)
 		}
 	} else {
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		// stdio goes to the host over vsock rather than the serial
+		// console, so stdout and stderr stay apart and bytes arrive
+		// unchanged.
+		closeChildEnds, err = mainIO.setup(cmd)
+		if err != nil {
+			return fmt.Errorf("set up stdio: %w", err)
+		}
+		// Own process group so signals from the host reach the whole job
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	}
 
-	if err := cmd.Start(); err != nil {
+	err = startAs(cmd, cfg.User)
+	closeChildEnds()
+	if err != nil {
 		return fmt.Errorf("start command: %w", err)
 	}
+	mainProcess.started(cmd.Process.Pid)
 
 	// Forward signals to the child
 	sigCh := make(chan os.Signal, 16)
 	signal.Notify(sigCh)
 	go func() {
 		for sig := range sigCh {
+			// SIGCHLD is for init itself (exec'd processes exiting)
+			if sig == syscall.SIGCHLD {
+				continue
+			}
 			if s, ok := sig.(syscall.Signal); ok {
 				cmd.Process.Signal(s)
 			}
 		}
 	}()
 
-	// Wait for the child to exit
+	// Wait for the child to exit, and for its output to reach the host
 	err = cmd.Wait()
+	if !cfg.Terminal {
+		mainIO.drain(outputDrainTimeout)
+	}
+
+	// Hand the exit status to the host before the VM goes away
+	mainProcess.exit(exitStatus(cmd.ProcessState))
+	mainProcess.waitDelivered(exitDeliveryTimeout)
 
 	// Shut down the VM
 	reboot()
 	return err // unreachable, but for completeness
 }
 
+// hasNameserver reports whether the resolv.conf at path names a nameserver.
+func hasNameserver(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "nameserver" {
+			return true
+		}
+	}
+	return false
+}
+
 func splitEnvVar(s string) [2]string {
 	for i := 0; i < len(s); i++ {
 		if s[i] == '=' {
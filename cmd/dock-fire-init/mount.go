@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+type initMount struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type initVolume struct {
+	Device      string `json:"device"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+}
+
+// mountOptions maps the mount options that are flags to their flag, and
+// whether the option clears it instead.
+var mountOptions = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":          {false, syscall.MS_RDONLY},
+	"rw":          {true, syscall.MS_RDONLY},
+	"nosuid":      {false, syscall.MS_NOSUID},
+	"suid":        {true, syscall.MS_NOSUID},
+	"nodev":       {false, syscall.MS_NODEV},
+	"dev":         {true, syscall.MS_NODEV},
+	"noexec":      {false, syscall.MS_NOEXEC},
+	"exec":        {true, syscall.MS_NOEXEC},
+	"sync":        {false, syscall.MS_SYNCHRONOUS},
+	"async":       {true, syscall.MS_SYNCHRONOUS},
+	"dirsync":     {false, syscall.MS_DIRSYNC},
+	"mand":        {false, syscall.MS_MANDLOCK},
+	"nomand":      {true, syscall.MS_MANDLOCK},
+	"atime":       {true, syscall.MS_NOATIME},
+	"noatime":     {false, syscall.MS_NOATIME},
+	"diratime":    {true, syscall.MS_NODIRATIME},
+	"nodiratime":  {false, syscall.MS_NODIRATIME},
+	"relatime":    {false, syscall.MS_RELATIME},
+	"norelatime":  {true, syscall.MS_RELATIME},
+	"strictatime": {false, syscall.MS_STRICTATIME},
+}
+
+// parseMountOptions splits options into mount flags and the data string
+// passed to the filesystem.
+func parseMountOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, o := range options {
+		if f, ok := mountOptions[o]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+			continue
+		}
+		data = append(data, o)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// mountAll performs the mounts in order, creating their mount points. They
+// go over the ones init made itself, e.g. a devpts with the spec's options.
+func mountAll(mounts []initMount) error {
+	for _, m := range mounts {
+		fstype := m.Type
+		if fstype == "cgroup" {
+			// The guest kernel only has the unified hierarchy
+			fstype = "cgroup2"
+		}
+		flags, data := parseMountOptions(m.Options)
+		if err := os.MkdirAll(m.Destination, 0o755); err != nil {
+			return fmt.Errorf("mkdir %s: %w", m.Destination, err)
+		}
+		if err := syscall.Mount(m.Source, m.Destination, fstype, flags, data); err != nil {
+			return fmt.Errorf("mount %s on %s: %w", fstype, m.Destination, err)
+		}
+		if fstype == "devpts" && m.Destination == "/dev/pts" {
+			// A new devpts instance has its own ptmx, which /dev/ptmx
+			// must open for the ptys to show up in /dev/pts
+			os.Remove("/dev/ptmx")
+			if err := os.Symlink("pts/ptmx", "/dev/ptmx"); err != nil {
+				return fmt.Errorf("link /dev/ptmx: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// mountVolumes mounts each volume's drive at its destination, in order.
+func mountVolumes(vols []initVolume) error {
+	for _, v := range vols {
+		var flags uintptr
+		if v.ReadOnly {
+			flags |= syscall.MS_RDONLY
+		}
+		if err := os.MkdirAll(v.Destination, 0o755); err != nil {
+			return fmt.Errorf("mkdir %s: %w", v.Destination, err)
+		}
+		if err := mountDevice(v.Device, v.Destination, flags); err != nil {
+			return fmt.Errorf("mount volume %s: %w", v.Destination, err)
+		}
+	}
+	return nil
+}
+
+// mountDevice mounts a block device, trying each filesystem the kernel
+// knows. Images built by the runtime are ext4, but a passed-through host
+// device can hold anything.
+func mountDevice(dev, target string, flags uintptr) error {
+	err := syscall.Mount(dev, target, "ext4", flags, "")
+	if err == nil {
+		return nil
+	}
+	for _, fstype := range blockFilesystems() {
+		if fstype == "ext4" {
+			continue
+		}
+		if syscall.Mount(dev, target, fstype, flags, "") == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// blockFilesystems lists the filesystems in /proc/filesystems that need a
+// device.
+func blockFilesystems() []string {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 1 {
+			types = append(types, fields[0])
+		}
+	}
+	return types
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// setAddress replaces the IPv4 addresses of iface with addr, a CIDR, and
+// routes everything else through gw. The kernel's ip= argument only applies
+// at boot, so this is how a restored VM follows a new subnet.
+func setAddress(iface, addr, gw string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("find %s: %w", iface, err)
+	}
+	a, err := netlink.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("parse address: %w", err)
+	}
+	gateway := net.ParseIP(gw)
+	if gateway == nil {
+		return fmt.Errorf("invalid gateway %q", gw)
+	}
+
+	old, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("list addresses of %s: %w", iface, err)
+	}
+	if err := netlink.AddrReplace(link, a); err != nil {
+		return fmt.Errorf("add %s to %s: %w", addr, iface, err)
+	}
+	for _, o := range old {
+		if !o.IP.Equal(a.IP) {
+			netlink.AddrDel(link, &o)
+		}
+	}
+	// Removing the old address took the old default route with it
+	if err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: gateway}); err != nil {
+		return fmt.Errorf("add default route via %s: %w", gw, err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rorym/dock-fire/internal/agent"
+)
+
+// pfKthread is the task flag the kernel sets on its own threads.
+const pfKthread = 0x00200000
+
+// listProcesses returns every user-space process in the guest.
+func listProcesses() ([]agent.ProcessInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("read /proc: %w", err)
+	}
+
+	var procs []agent.ProcessInfo
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		info, ok := readProcess(pid)
+		if !ok {
+			// Exited while we were looking, or a kernel thread
+			continue
+		}
+		procs = append(procs, info)
+	}
+	return procs, nil
+}
+
+func readProcess(pid int) (agent.ProcessInfo, bool) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return agent.ProcessInfo{}, false
+	}
+
+	// comm may contain spaces and parentheses, so split on the last ')'
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return agent.ProcessInfo{}, false
+	}
+	comm := string(stat[open+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	// fields[0] is state (field 3 in proc(5)), so field n is fields[n-3]
+	if len(fields) < 7 {
+		return agent.ProcessInfo{}, false
+	}
+	flags, _ := strconv.ParseUint(fields[6], 10, 64)
+	if flags&pfKthread != 0 {
+		return agent.ProcessInfo{}, false
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+
+	info := agent.ProcessInfo{
+		PID:     pid,
+		PPID:    ppid,
+		State:   fields[0],
+		Command: "[" + comm + "]",
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		info.Command = strings.Join(args, " ")
+	}
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "Uid:") {
+				if f := strings.Fields(line); len(f) > 1 {
+					info.UID, _ = strconv.Atoi(f[1])
+				}
+				break
+			}
+		}
+	}
+	return info, true
+}
+
+// guestStats counts user-space processes and OOM kills since boot.
+func guestStats() (*agent.GuestStats, error) {
+	procs, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+	stats := &agent.GuestStats{Pids: len(procs)}
+
+	vmstat, err := os.ReadFile("/proc/vmstat")
+	if err != nil {
+		return nil, fmt.Errorf("read /proc/vmstat: %w", err)
+	}
+	for _, line := range strings.Split(string(vmstat), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "oom_kill" {
+			stats.OOMKills, _ = strconv.ParseUint(f[1], 10, 64)
+			break
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/agent"
+)
+
+// outputDrainTimeout bounds how long init waits, once the main process has
+// exited, for output still in its pipes to reach the host. A background
+// process that inherited the pipes can hold them open indefinitely.
+const outputDrainTimeout = 2 * time.Second
+
+// mainIO carries a non-terminal main process's stdio.
+var mainIO = newStdioRelay()
+
+// stdioRelay connects a process's stdio pipes to the agent connection of
+// the host's stdio wait request. Output waits while no connection is
+// attached, so nothing is lost before the host attaches or while it
+// reconnects after a snapshot; the process just blocks on a full pipe.
+type stdioRelay struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	fw    *agent.FrameWriter
+	stdin io.WriteCloser
+	pumps sync.WaitGroup
+	// stdinR is the child's end of the stdin pipe, made before the child
+	// so input sent ahead of start waits in the pipe.
+	stdinR *os.File
+}
+
+func newStdioRelay() *stdioRelay {
+	r := &stdioRelay{}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// openStdin makes the stdin pipe. It is done as soon as init knows the
+// process isn't on a terminal, since the host relays stdin from create on:
+// input and its end are held in the pipe until the process starts. Writes
+// block once the pipe is full.
+func (r *stdioRelay) openStdin() error {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.stdin = inW
+	r.stdinR = inR
+	r.mu.Unlock()
+	return nil
+}
+
+// setup gives cmd the stdin pipe and pipes for stdout and stderr, and starts
+// pumping its output. The returned function closes the child's ends once it
+// has started.
+func (r *stdioRelay) setup(cmd *exec.Cmd) (func(), error) {
+	r.mu.Lock()
+	inR := r.stdinR
+	r.mu.Unlock()
+	if inR == nil {
+		return nil, fmt.Errorf("stdin pipe not open")
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, errW
+
+	r.pumps.Add(2)
+	go r.pump(outR, agent.FrameStdout)
+	go r.pump(errR, agent.FrameStderr)
+
+	return func() {
+		inR.Close()
+		outW.Close()
+		errW.Close()
+	}, nil
+}
+
+// pump frames everything read from f until it hits EOF.
+func (r *stdioRelay) pump(f *os.File, typ byte) {
+	defer r.pumps.Done()
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			r.write(typ, buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write sends one chunk of output, waiting for a connection to be attached
+// and moving to the next one if the current connection fails.
+func (r *stdioRelay) write(typ byte, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		for r.fw == nil {
+			r.cond.Wait()
+		}
+		fw := r.fw
+		r.mu.Unlock()
+		err := fw.WriteFrame(typ, p)
+		r.mu.Lock()
+		if err == nil {
+			return
+		}
+		if r.fw == fw {
+			r.fw = nil
+		}
+	}
+}
+
+// attach makes fw the connection output is sent on.
+func (r *stdioRelay) attach(fw *agent.FrameWriter) {
+	r.mu.Lock()
+	r.fw = fw
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+// detach stops using fw, unless another connection has already taken over.
+func (r *stdioRelay) detach(fw *agent.FrameWriter) {
+	r.mu.Lock()
+	if r.fw == fw {
+		r.fw = nil
+	}
+	r.mu.Unlock()
+}
+
+// writeStdin passes input from the host to the process. Only input after
+// closeStdin is dropped.
+func (r *stdioRelay) writeStdin(p []byte) {
+	r.mu.Lock()
+	w := r.stdin
+	r.mu.Unlock()
+	if w != nil {
+		w.Write(p)
+	}
+}
+
+// closeStdin closes the process's stdin once the host's input has ended,
+// so it reads EOF. That can be before start: the pipe holds what was
+// written, and the process reads it and then EOF. Input arriving
+// afterwards is dropped.
+func (r *stdioRelay) closeStdin() {
+	r.mu.Lock()
+	w := r.stdin
+	r.stdin = nil
+	r.mu.Unlock()
+	if w != nil {
+		w.Close()
+	}
+}
+
+// drain waits for the output pipes to reach EOF, up to timeout.
+func (r *stdioRelay) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		r.pumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// reportError sends msg on stderr if the host is attached. It is for init's
+// own errors, which otherwise only reach the VM's serial console log.
+func (r *stdioRelay) reportError(msg string) {
+	r.mu.Lock()
+	fw := r.fw
+	r.mu.Unlock()
+	if fw != nil {
+		fw.WriteFrame(agent.FrameStderr, []byte(msg))
+	}
+}
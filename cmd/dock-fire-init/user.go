@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rorym/dock-fire/internal/agent"
+)
+
+// credential returns the credential a process runs with as u. Its groups
+// are exactly the additional gids, so none are inherited from init.
+func credential(u agent.User) *syscall.Credential {
+	groups := u.AdditionalGids
+	if groups == nil {
+		groups = []uint32{}
+	}
+	return &syscall.Credential{Uid: u.UID, Gid: u.GID, Groups: groups}
+}
+
+// startAs starts cmd as u, with u's umask if it has one. The umask is
+// process-wide, so it is only changed for the fork.
+func startAs(cmd *exec.Cmd, u agent.User) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential(u)
+	if u.Umask == nil {
+		return cmd.Start()
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(*u.Umask))
+	defer syscall.Umask(old)
+	return cmd.Start()
+}
+
+// umaskMu keeps concurrent starts from seeing each other's umask.
+var umaskMu sync.Mutex
+
+// withHome adds HOME to env if it is missing, from the user's entry in the
+// guest's /etc/passwd, or / if there is none, as runc does.
+func withHome(env []string, uid uint32) []string {
+	for _, e := range env {
+		if strings.HasPrefix(e, "HOME=") {
+			return env
+		}
+	}
+	return append(env, "HOME="+homeDir(uid))
+}
+
+func homeDir(uid uint32) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/"
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 6 {
+			continue
+		}
+		if id, err := strconv.ParseUint(fields[2], 10, 32); err == nil && uint32(id) == uid && fields[5] != "" {
+			return fields[5]
+		}
+	}
+	return "/"
+}
@@ -32,10 +32,9 @@ func main() {
 				Name:  "debug",
 				Usage: "enable debug logging",
 			},
-			// systemd-cgroup is expected by containerd but we don't use it
 			&cli.BoolFlag{
-				Name:   "systemd-cgroup",
-				Hidden: true,
+				Name:  "systemd-cgroup",
+				Usage: "place the VM in a systemd transient scope (cgroupsPath is slice:prefix:name)",
 			},
 		},
 		Before: func(c *cli.Context) error {
@@ -58,10 +57,22 @@ func main() {
 		},
 		Commands: []*cli.Command{
 			runtime.CreateCommand,
+			runtime.RunCommand,
 			runtime.StartCommand,
 			runtime.StateCommand,
 			runtime.KillCommand,
 			runtime.DeleteCommand,
+			runtime.ListCommand,
+			runtime.PsCommand,
+			runtime.PauseCommand,
+			runtime.ResumeCommand,
+			runtime.CheckpointCommand,
+			runtime.RestoreCommand,
+			runtime.UpdateCommand,
+			runtime.EventsCommand,
+			runtime.FeaturesCommand,
+			runtime.ExecCommand,
+			runtime.RelayCommand,
 		},
 	}
 
@@ -0,0 +1,268 @@
+// Package agent defines the protocol spoken between the dock-fire runtime on
+// the host and dock-fire-init inside the guest.
+//
+// The host connects to the guest over the Firecracker vsock device. Every
+// message on the connection is a frame: a one-byte frame type, a four-byte
+// big-endian payload length, then the payload. The first frame in each
+// direction is a FrameMessage carrying a JSON Request (host to guest) and
+// Response (guest to host). For exec and wait requests the connection then
+// carries stdio, resize and exit frames until the process exits. Stdio
+// frames carry raw bytes, so output is binary-safe and stdout and stderr
+// stay apart.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Port is the vsock port dock-fire-init listens on inside the guest.
+const Port uint32 = 1024
+
+// GuestCID is the vsock context ID assigned to every guest.
+const GuestCID uint32 = 3
+
+// maxFrameSize bounds a single frame so a corrupt header can't make the
+// reader allocate arbitrary amounts of memory.
+const maxFrameSize = 1 << 20
+
+// Frame types.
+const (
+	FrameMessage byte = iota // JSON-encoded Request or Response
+	FrameStdin
+	FrameStdout
+	FrameStderr
+	FrameResize     // JSON-encoded WindowSize
+	FrameExit       // JSON-encoded ExitStatus
+	FrameStdinClose // host stdin reached EOF; no payload
+)
+
+// Request types.
+const (
+	RequestExec = "exec"
+	// RequestStart releases the container's main process, which
+	// dock-fire-init holds back until the runtime's start action.
+	RequestStart = "start"
+	// RequestPs lists the processes running in the guest.
+	RequestPs = "ps"
+	// RequestStats reports guest-side resource counters.
+	RequestStats = "stats"
+	// RequestSignal delivers Signal to the main process's process group,
+	// to PID's group when it is set, or to every guest process when All is
+	// set.
+	RequestSignal = "signal"
+	// RequestWait blocks until the container's main process exits and then
+	// sends its ExitStatus in a FrameExit. With Stdio set, the connection
+	// carries a non-terminal main process's stdin, stdout and stderr
+	// frames until then.
+	RequestWait = "wait"
+	// RequestHooks runs Hooks inside the guest, in order, with State on
+	// their stdin. It carries the container-side OCI hooks.
+	RequestHooks = "hooks"
+	// RequestNetwork moves the guest's eth0 to Address, a CIDR, with a
+	// default route through Gateway. A VM restored onto another subnet
+	// needs it.
+	RequestNetwork = "network"
+)
+
+// Request is sent by the host as the first frame on a connection.
+type Request struct {
+	Type    string   `json:"type"`
+	Process *Process `json:"process,omitempty"`
+	Signal  int      `json:"signal,omitempty"`
+	PID     int      `json:"pid,omitempty"`
+	All     bool     `json:"all,omitempty"`
+	// Stdio attaches the main process's stdio to a wait request's
+	// connection, taking over from any earlier one.
+	Stdio bool `json:"stdio,omitempty"`
+	// Hook names the lifecycle point of Hooks, for error messages.
+	Hook  string          `json:"hook,omitempty"`
+	Hooks []specs.Hook    `json:"hooks,omitempty"`
+	State json.RawMessage `json:"state,omitempty"`
+	// Address and Gateway are set for network requests.
+	Address string `json:"address,omitempty"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Response is the guest's reply to a Request.
+type Response struct {
+	Error string `json:"error,omitempty"`
+	PID   int    `json:"pid,omitempty"`
+	// Processes is the guest process table, set for ps requests.
+	Processes []ProcessInfo `json:"processes,omitempty"`
+	// Stats is set for stats requests.
+	Stats *GuestStats `json:"stats,omitempty"`
+}
+
+// GuestStats are counters only the guest kernel knows.
+type GuestStats struct {
+	Pids     int    `json:"pids"`
+	OOMKills uint64 `json:"oomKills"`
+}
+
+// Process describes a process to start inside the guest.
+type Process struct {
+	Args     []string `json:"args"`
+	Env      []string `json:"env,omitempty"`
+	Cwd      string   `json:"cwd,omitempty"`
+	Terminal bool     `json:"terminal,omitempty"`
+	User     User     `json:"user"`
+}
+
+// User is who a guest process runs as. The zero value is root.
+type User struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+	Umask          *uint32  `json:"umask,omitempty"`
+}
+
+// UserFromSpec returns the user of an OCI process.
+func UserFromSpec(u specs.User) User {
+	return User{UID: u.UID, GID: u.GID, AdditionalGids: u.AdditionalGids, Umask: u.Umask}
+}
+
+// ProcessInfo describes one process running in the guest.
+type ProcessInfo struct {
+	PID     int    `json:"pid"`
+	PPID    int    `json:"ppid"`
+	UID     int    `json:"uid"`
+	State   string `json:"state"`
+	Command string `json:"command"`
+}
+
+// WindowSize is the terminal size carried by FrameResize.
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// ExitStatus reports how a guest process terminated. Signal is non-zero when
+// the process was killed by a signal.
+type ExitStatus struct {
+	Code   int `json:"code"`
+	Signal int `json:"signal,omitempty"`
+}
+
+// ExitCode returns the status as a shell-style exit code (128+signal for
+// signalled processes).
+func (s ExitStatus) ExitCode() int {
+	if s.Signal != 0 {
+		return 128 + s.Signal
+	}
+	return s.Code
+}
+
+// WriteFrame writes a single frame to w.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFrame reads a single frame from r.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// WriteJSON marshals v and writes it as a frame of the given type.
+func WriteJSON(w io.Writer, typ byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, typ, data)
+}
+
+// ReadMessage reads a FrameMessage from r and unmarshals it into v.
+func ReadMessage(r io.Reader, v interface{}) error {
+	typ, payload, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+	if typ != FrameMessage {
+		return fmt.Errorf("expected message frame, got type %d", typ)
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// FrameWriter serialises frames from multiple goroutines onto one writer.
+type FrameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame writes a single frame, holding the lock for the whole frame.
+func (f *FrameWriter) WriteFrame(typ byte, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return WriteFrame(f.w, typ, payload)
+}
+
+// WriteJSON marshals v and writes it as a single frame.
+func (f *FrameWriter) WriteJSON(typ byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.WriteFrame(typ, data)
+}
+
+// Stream returns an io.Writer that wraps every write in a frame of type typ.
+func (f *FrameWriter) Stream(typ byte) io.Writer {
+	return streamWriter{f: f, typ: typ}
+}
+
+type streamWriter struct {
+	f   *FrameWriter
+	typ byte
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		if err := s.f.WriteFrame(s.typ, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
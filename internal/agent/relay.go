@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Relay pumps stdio between the host and a guest process over conn until the
+// guest reports the process's exit status. stdin may be nil; when it ends,
+// the guest is told so it can close the process's stdin. The same stdin can
+// be given to a later Relay once this one has returned. Window sizes
+// received on resize are forwarded to the guest's terminal. A nil stderr
+// shares stdout.
+func Relay(conn io.ReadWriter, stdin *Stdin, stdout, stderr io.Writer, resize <-chan WindowSize) (ExitStatus, error) {
+	fw := NewFrameWriter(conn)
+	if stderr == nil {
+		stderr = stdout
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if stdin != nil {
+		go stdin.send(fw, done)
+	}
+	if resize != nil {
+		go func() {
+			for size := range resize {
+				if err := fw.WriteJSON(FrameResize, size); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		typ, payload, err := ReadFrame(conn)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ExitStatus{}, fmt.Errorf("connection closed before exit status was received")
+			}
+			return ExitStatus{}, fmt.Errorf("read frame: %w", err)
+		}
+		switch typ {
+		case FrameStdout:
+			stdout.Write(payload)
+		case FrameStderr:
+			stderr.Write(payload)
+		case FrameExit:
+			var status ExitStatus
+			if err := json.Unmarshal(payload, &status); err != nil {
+				return ExitStatus{}, fmt.Errorf("parse exit status: %w", err)
+			}
+			return status, nil
+		}
+	}
+}
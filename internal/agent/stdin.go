@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"io"
+	"sync"
+)
+
+// stdinChunkSize is how much host input is read at a time.
+const stdinChunkSize = 32 * 1024
+
+// Stdin reads host input once for a series of relays, as when a monitor
+// reconnects after a snapshot resets its connection. Input is only taken
+// from the reader by one goroutine, and a chunk that couldn't be sent on a
+// dead connection is sent on the next one.
+type Stdin struct {
+	chunks chan []byte // closed once the reader ends
+
+	// mu is held by the relay currently sending, so a new one waits for
+	// the last to give up.
+	mu      sync.Mutex
+	pending []byte
+}
+
+// NewStdin starts reading r. It returns nil for a nil r.
+func NewStdin(r io.Reader) *Stdin {
+	if r == nil {
+		return nil
+	}
+	s := &Stdin{chunks: make(chan []byte)}
+	go func() {
+		defer close(s.chunks)
+		for {
+			buf := make([]byte, stdinChunkSize)
+			n, err := r.Read(buf)
+			if n > 0 {
+				s.chunks <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// send forwards input over fw until it ends, then reports the end. It gives
+// up when a write fails or done is closed, keeping what wasn't sent.
+func (s *Stdin) send(fw *FrameWriter, done <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		chunk := s.pending
+		if chunk == nil {
+			select {
+			case c, ok := <-s.chunks:
+				if !ok {
+					fw.WriteFrame(FrameStdinClose, nil)
+					return
+				}
+				chunk = c
+			case <-done:
+				return
+			}
+		}
+		if err := fw.WriteFrame(FrameStdin, chunk); err != nil {
+			s.pending = chunk
+			return
+		}
+		s.pending = nil
+	}
+}
@@ -0,0 +1,200 @@
+// Package cgroup places a container's Firecracker process in the cgroup
+// named by its spec, so the host accounts and limits the VM like any other
+// container. Only the unified (v2) hierarchy is supported.
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/sirupsen/logrus"
+)
+
+// Root is where the unified hierarchy is mounted.
+const Root = "/sys/fs/cgroup"
+
+// VMMOverheadMiB is allowed in the cgroup's memory limit on top of guest
+// memory, for Firecracker's own allocations and the monitor process.
+const VMMOverheadMiB = 64
+
+// defaultParent holds the cgroups of containers whose spec names none.
+const defaultParent = "dock-fire"
+
+// Resolve records in ctr the cgroup Setup will create, without creating
+// it, so it can be released even if setting it up is interrupted. With
+// ctr.SystemdCgroup it is a transient systemd scope, otherwise a directory
+// under Root.
+func Resolve(ctr *container.Container, spec *specs.Spec) error {
+	cgroupsPath := specCgroupsPath(spec)
+	if ctr.SystemdCgroup {
+		slice, unit, err := systemdUnit(cgroupsPath, ctr.ID)
+		if err != nil {
+			return err
+		}
+		ctr.CgroupUnit = unit
+		ctr.CgroupPath = filepath.Join(Root, expandSlice(slice), unit)
+		return nil
+	}
+	if cgroupsPath == "" {
+		cgroupsPath = filepath.Join(defaultParent, ctr.ID)
+	}
+	ctr.CgroupPath = filepath.Join(Root, filepath.Clean("/"+cgroupsPath))
+	return nil
+}
+
+// Requested reports whether the caller asked for a cgroup, through
+// --systemd-cgroup or the spec's cgroupsPath, rather than getting the
+// default one. Failing to set up a requested cgroup fails the container.
+func Requested(ctr *container.Container, spec *specs.Spec) bool {
+	return ctr.SystemdCgroup || specCgroupsPath(spec) != ""
+}
+
+// Setup creates the cgroup for ctr, resolving it first if that hasn't been
+// done, moves pid into it and applies host limits: memory for the VM plus
+// VMM overhead, and the spec's CPU quota.
+func Setup(ctr *container.Container, spec *specs.Spec, pid int) error {
+	if _, err := os.Stat(filepath.Join(Root, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("cgroup v2 is not mounted at %s", Root)
+	}
+	if ctr.CgroupPath == "" {
+		if err := Resolve(ctr, spec); err != nil {
+			return err
+		}
+	}
+
+	if ctr.CgroupUnit != "" {
+		slice, _, err := systemdUnit(specCgroupsPath(spec), ctr.ID)
+		if err != nil {
+			return err
+		}
+		if err := startScope(ctr.CgroupUnit, slice, pid, scopeLimits(ctr, spec)); err != nil {
+			return err
+		}
+		logrus.Debugf("container %s: VMM in scope %s", ctr.ID, ctr.CgroupUnit)
+		return nil
+	}
+
+	dir := ctr.CgroupPath
+	if err := enableControllers(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create cgroup: %w", err)
+	}
+	if err := applyLimits(dir, ctr, spec); err != nil {
+		return err
+	}
+	if err := AddProcess(ctr, pid); err != nil {
+		return err
+	}
+	logrus.Debugf("container %s: VMM in cgroup %s", ctr.ID, dir)
+	return nil
+}
+
+// AddProcess moves pid into the container's cgroup.
+func AddProcess(ctr *container.Container, pid int) error {
+	if ctr.CgroupPath == "" {
+		return nil
+	}
+	if err := writeFile(ctr.CgroupPath, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return fmt.Errorf("move PID %d to cgroup: %w", pid, err)
+	}
+	return nil
+}
+
+// Remove deletes the container's cgroup. Processes in it may take a moment
+// to exit after being killed, so removal is retried for a while.
+func Remove(ctr *container.Container) error {
+	if ctr.CgroupUnit != "" {
+		// The scope goes away by itself once empty; stopping it also
+		// kills anything left behind
+		exec.Command("systemctl", "stop", ctr.CgroupUnit).Run()
+		return nil
+	}
+	if ctr.CgroupPath == "" {
+		return nil
+	}
+	var err error
+	for range 20 {
+		err = os.Remove(ctr.CgroupPath)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("remove cgroup %s: %w", ctr.CgroupPath, err)
+}
+
+// enableControllers turns on the cpu and memory controllers for the
+// children of every ancestor of dir, so they can be limited in dir.
+func enableControllers(dir string) error {
+	rel, err := filepath.Rel(Root, filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+	parent := Root
+	for _, elem := range append([]string{""}, strings.Split(rel, string(filepath.Separator))...) {
+		if elem == "." {
+			continue
+		}
+		parent = filepath.Join(parent, elem)
+		if err := os.MkdirAll(parent, 0o755); err != nil {
+			return fmt.Errorf("create cgroup: %w", err)
+		}
+		if err := writeFile(parent, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+			return fmt.Errorf("enable controllers in %s: %w", parent, err)
+		}
+	}
+	return nil
+}
+
+// applyLimits writes the host limits into the cgroup at dir.
+func applyLimits(dir string, ctr *container.Container, spec *specs.Spec) error {
+	if ctr.MemoryMiB > 0 {
+		limit := (ctr.MemoryMiB + VMMOverheadMiB) << 20
+		if err := writeFile(dir, "memory.max", strconv.FormatInt(limit, 10)); err != nil {
+			return fmt.Errorf("set memory limit: %w", err)
+		}
+	}
+	if quota, period := cpuQuota(spec); quota > 0 {
+		if err := writeFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, period)); err != nil {
+			return fmt.Errorf("set CPU quota: %w", err)
+		}
+	}
+	return nil
+}
+
+// cpuQuota returns the spec's CPU quota and period in microseconds, or a
+// zero quota if it has none.
+func cpuQuota(spec *specs.Spec) (quota int64, period uint64) {
+	if spec.Linux == nil || spec.Linux.Resources == nil || spec.Linux.Resources.CPU == nil {
+		return 0, 0
+	}
+	cpu := spec.Linux.Resources.CPU
+	if cpu.Quota == nil || *cpu.Quota <= 0 {
+		return 0, 0
+	}
+	period = 100000
+	if cpu.Period != nil && *cpu.Period > 0 {
+		period = *cpu.Period
+	}
+	return *cpu.Quota, period
+}
+
+func specCgroupsPath(spec *specs.Spec) string {
+	if spec.Linux == nil {
+		return ""
+	}
+	return spec.Linux.CgroupsPath
+}
+
+func writeFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644)
+}
@@ -0,0 +1,116 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rorym/dock-fire/internal/container"
+)
+
+// scopeTimeout bounds how long Setup waits for systemd to start a scope.
+const scopeTimeout = 2 * time.Second
+
+// property is a systemd unit property as busctl takes it: name, D-Bus
+// signature, then the value's arguments.
+type property []string
+
+// systemdUnit parses a systemd cgroups path, "slice:prefix:name", into the
+// slice and the name of the scope to create. An empty path gets a scope in
+// system.slice.
+func systemdUnit(cgroupsPath, id string) (slice, unit string, err error) {
+	if cgroupsPath == "" {
+		return "system.slice", defaultParent + "-" + id + ".scope", nil
+	}
+	parts := strings.Split(cgroupsPath, ":")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("cgroups path %q is not slice:prefix:name", cgroupsPath)
+	}
+	slice, prefix, name := parts[0], parts[1], parts[2]
+	if slice == "" {
+		slice = "system.slice"
+	}
+	if strings.HasSuffix(name, ".slice") {
+		return "", "", fmt.Errorf("cgroups path %q names a slice, not a scope", cgroupsPath)
+	}
+	if prefix != "" {
+		name = prefix + "-" + name
+	}
+	return slice, name + ".scope", nil
+}
+
+// expandSlice returns the cgroup path of a slice: "a-b.slice" lives in
+// a.slice/a-b.slice.
+func expandSlice(slice string) string {
+	name := strings.TrimSuffix(slice, ".slice")
+	if name == "-" || name == "" {
+		return ""
+	}
+	var path, prefix string
+	for _, part := range strings.Split(name, "-") {
+		prefix += part
+		path = filepath.Join(path, prefix+".slice")
+		prefix += "-"
+	}
+	return path
+}
+
+// scopeLimits returns the host limits as scope properties.
+func scopeLimits(ctr *container.Container, spec *specs.Spec) []property {
+	props := []property{
+		{"MemoryAccounting", "b", "true"},
+		{"CPUAccounting", "b", "true"},
+	}
+	if ctr.MemoryMiB > 0 {
+		limit := (ctr.MemoryMiB + VMMOverheadMiB) << 20
+		props = append(props, property{"MemoryMax", "t", strconv.FormatInt(limit, 10)})
+	}
+	if quota, period := cpuQuota(spec); quota > 0 {
+		perSec := uint64(quota) * 1000000 / period
+		props = append(props, property{"CPUQuotaPerSecUSec", "t", strconv.FormatUint(perSec, 10)})
+	}
+	return props
+}
+
+// startScope asks systemd to start a transient scope holding pid, and waits
+// until pid has been moved into it.
+func startScope(unit, slice string, pid int, limits []property) error {
+	props := append([]property{
+		{"Description", "s", "dock-fire VM " + unit},
+		{"Slice", "s", slice},
+		{"PIDs", "au", "1", strconv.Itoa(pid)},
+	}, limits...)
+
+	args := []string{"call", "org.freedesktop.systemd1", "/org/freedesktop/systemd1",
+		"org.freedesktop.systemd1.Manager", "StartTransientUnit", "ssa(sv)a(sa(sv))",
+		unit, "fail", strconv.Itoa(len(props))}
+	for _, p := range props {
+		args = append(args, p...)
+	}
+	args = append(args, "0")
+
+	if out, err := exec.Command("busctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("start scope %s: %w: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+
+	want := "0::/" + filepath.Join(expandSlice(slice), unit)
+	deadline := time.Now().Add(scopeTimeout)
+	for {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+		if err != nil {
+			return fmt.Errorf("read cgroup of PID %d: %w", pid, err)
+		}
+		if strings.TrimSpace(string(data)) == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for scope %s", unit)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
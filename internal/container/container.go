@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type Status string
@@ -14,6 +15,7 @@ const (
 	Creating Status = "creating"
 	Created  Status = "created"
 	Running  Status = "running"
+	Paused   Status = "paused"
 	Stopped  Status = "stopped"
 )
 
@@ -23,14 +25,78 @@ type Container struct {
 	Bundle string `json:"bundle"`
 	Status Status `json:"status"`
 	PID    int    `json:"pid,omitempty"` // VMM process PID
+	// MonitorPID is the host process that waits on the guest's main process
+	// and exits with its status. It is the PID reported to containerd.
+	MonitorPID int `json:"monitorPID,omitempty"`
+	// Exit status of the guest's main process, recorded by the monitor.
+	ExitCode   *int   `json:"exitCode,omitempty"`
+	ExitSignal string `json:"exitSignal,omitempty"`
+	Created    time.Time `json:"created,omitempty"`
+	// LastCheckpoint is the image path of the most recent checkpoint of
+	// this VM, the only valid parent for a diff snapshot.
+	LastCheckpoint string `json:"lastCheckpoint,omitempty"`
 	// Internal fields not in OCI state
 	RootDir  string `json:"rootDir"`  // state directory root (e.g. /run/dock-fire)
 	ImagePath string `json:"imagePath,omitempty"` // ext4 rootfs image
 	SocketPath string `json:"socketPath,omitempty"` // Firecracker API socket
+	VsockPath  string `json:"vsockPath,omitempty"`  // host side of the guest agent vsock
 	TapDevice  string `json:"tapDevice,omitempty"`
 	GuestIP   string `json:"guestIP,omitempty"`
 	HostIP    string `json:"hostIP,omitempty"`
 	SubnetCIDR string `json:"subnetCIDR,omitempty"`
+	// VM size as booted
+	VCPUs     int64 `json:"vcpus,omitempty"`
+	MemoryMiB int64 `json:"memoryMiB,omitempty"`
+	// MemoryHeadroomMiB is how much of MemoryMiB was added on top of the
+	// spec's memory limit for the guest itself.
+	MemoryHeadroomMiB int64 `json:"memoryHeadroomMiB,omitempty"`
+	// SystemdCgroup puts the VMM in a systemd scope rather than a cgroupfs
+	// directory. CgroupPath is the cgroup it runs in, and CgroupUnit the
+	// scope, if any.
+	SystemdCgroup bool   `json:"systemdCgroup,omitempty"`
+	CgroupPath    string `json:"cgroupPath,omitempty"`
+	CgroupUnit    string `json:"cgroupUnit,omitempty"`
+	// Volumes are attached to the VM as extra drives, in order after the
+	// root drive.
+	Volumes []Volume `json:"volumes,omitempty"`
+	// Limits are the live resource limits applied by update.
+	Limits Limits `json:"limits,omitempty"`
+}
+
+// Volume is a host path the guest mounts from an extra drive.
+type Volume struct {
+	// Source is the host directory or block device of a bind mount.
+	Source string `json:"source,omitempty"`
+	// Name is set instead for a named volume from the volume store.
+	Name        string `json:"name,omitempty"`
+	Destination string `json:"destination"`
+	// Image is the drive image built from a directory Source, or the
+	// named volume's image. A block device is attached directly and has
+	// none.
+	Image    string `json:"image,omitempty"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+	// Lock is the named volume's lock file, held by the VMM while it runs.
+	Lock string `json:"lock,omitempty"`
+}
+
+// DrivePath is the host path attached to the VM for v.
+func (v Volume) DrivePath() string {
+	if v.Image != "" {
+		return v.Image
+	}
+	return v.Source
+}
+
+// Limits records resource limits in force on a running VM. Zero means
+// unlimited.
+type Limits struct {
+	// MemoryMiB is the guest memory left after inflating the balloon.
+	MemoryMiB int64 `json:"memoryMiB,omitempty"`
+	// Disk limits apply to reads and writes on the root drive combined.
+	DiskBps  int64 `json:"diskBps,omitempty"`
+	DiskIOPS int64 `json:"diskIOPS,omitempty"`
+	NetRxBps int64 `json:"netRxBps,omitempty"`
+	NetTxBps int64 `json:"netTxBps,omitempty"`
 }
 
 func (c *Container) stateDir() string {
@@ -60,9 +126,10 @@ func (c *Container) Save() error {
 // Transition moves the container to a new status, enforcing the state machine.
 func (c *Container) Transition(to Status) error {
 	valid := map[Status][]Status{
-		Creating: {Created},
+		Creating: {Created, Running}, // restore goes straight to running
 		Created:  {Running},
-		Running:  {Stopped},
+		Running:  {Paused, Stopped},
+		Paused:   {Running, Stopped},
 	}
 	allowed, ok := valid[c.Status]
 	if !ok {
@@ -90,9 +157,30 @@ func (c *Container) IsVMMAlive() bool {
 	return proc.Signal(syscall.Signal(0)) == nil
 }
 
-// EffectiveStatus returns the real status, checking if a "running" container's VMM has exited.
+// ProcessPID returns the PID that represents the container's main process
+// on the host: the monitor when there is one, otherwise the VMM.
+func (c *Container) ProcessPID() int {
+	if c.MonitorPID > 0 {
+		return c.MonitorPID
+	}
+	return c.PID
+}
+
+// HostPIDs returns the host processes that make up the container: the
+// monitor, if there is one, and the VMM.
+func (c *Container) HostPIDs() []int {
+	var pids []int
+	for _, pid := range []int{c.MonitorPID, c.PID} {
+		if pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// EffectiveStatus returns the real status, checking if a live container's VMM has exited.
 func (c *Container) EffectiveStatus() Status {
-	if c.Status == Running && !c.IsVMMAlive() {
+	if (c.Status == Created || c.Status == Running || c.Status == Paused) && !c.IsVMMAlive() {
 		return Stopped
 	}
 	return c.Status
@@ -0,0 +1,96 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Undo kinds, one for each resource create acquires.
+const (
+	UndoStateDir = "state-dir" // Path is the state directory
+	UndoImage    = "image"     // Path is the rootfs image
+	UndoNetwork  = "network"   // TAP device, and NAT rules for Subnet
+	UndoVM       = "vm"        // VMM process PID and its Sockets
+	UndoCgroup   = "cgroup"    // Path is the cgroup, Unit its systemd scope
+)
+
+// UndoEntry records one resource acquired by create, with what is needed to
+// release it without the container's state file.
+type UndoEntry struct {
+	Kind    string   `json:"kind"`
+	Path    string   `json:"path,omitempty"`
+	TAP     string   `json:"tap,omitempty"`
+	Subnet  string   `json:"subnet,omitempty"`
+	PID     int      `json:"pid,omitempty"`
+	Sockets []string `json:"sockets,omitempty"`
+	Unit    string   `json:"unit,omitempty"`
+}
+
+// Journal is the undo journal of a container being created: one JSON entry
+// per line in the state directory. Each entry is synced to disk before
+// create goes on to acquire the resource, so a create that is killed can
+// still be unwound by a later delete.
+type Journal struct {
+	path string
+}
+
+// NewJournal returns the undo journal for container id.
+func NewJournal(rootDir, id string) *Journal {
+	return &Journal{path: filepath.Join(rootDir, id, "undo.jsonl")}
+}
+
+// Record appends e to the journal.
+func (j *Journal) Record(e UndoEntry) error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return fmt.Errorf("mkdir state dir: %w", err)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal undo entry: %w", err)
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open undo journal: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write undo journal: %w", err)
+	}
+	return f.Sync()
+}
+
+// Entries returns the recorded entries, oldest first. A missing journal has
+// none. A line torn by a killed write is skipped.
+func (j *Journal) Entries() ([]UndoEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open undo journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []UndoEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e UndoEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Commit discards the journal once create has succeeded and the container
+// state owns the resources.
+func (j *Journal) Commit() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove undo journal: %w", err)
+	}
+	return nil
+}
@@ -20,9 +20,59 @@ type Subnet struct {
 // AllocateSubnet finds the next free /30 subnet from 10.0.0.0/16.
 // It scans existing containers to avoid collisions.
 func AllocateSubnet(rootDir string) (*Subnet, error) {
-	// Collect used subnets from both container state and live TAP devices.
-	// Stale TAPs from crashed containers won't appear in state files,
-	// so we also scan the host's network interfaces.
+	used, err := usedSubnets(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate /30 subnets within 10.0.0.0/16
+	// Each /30 gives us 4 IPs: network, host, guest, broadcast
+	// Start from 10.0.0.0/30, step by 4
+	base := net.ParseIP("10.0.0.0").To4()
+	for i := 0; i < 16384; i++ {
+		offset := uint32(i * 4)
+		networkIP := make(net.IP, 4)
+		copy(networkIP, base)
+		networkIP[2] = byte(offset >> 8)
+		networkIP[3] = byte(offset & 0xff)
+
+		cidr := fmt.Sprintf("%s/30", networkIP.String())
+		if used[cidr] {
+			continue
+		}
+
+		subnet := subnetAt(networkIP)
+		logrus.Debugf("allocated subnet %s (host=%s, guest=%s)", cidr, subnet.HostIP, subnet.GuestIP)
+		return subnet, nil
+	}
+
+	return nil, fmt.Errorf("no free /30 subnets available in 10.0.0.0/16")
+}
+
+// ReserveSubnet claims a specific /30, as used by a container restored from
+// a checkpoint whose guest already has its address configured.
+func ReserveSubnet(rootDir, cidr string) (*Subnet, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("parse subnet: %w", err)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones != 30 || ip.To4() == nil {
+		return nil, fmt.Errorf("subnet %s is not an IPv4 /30", cidr)
+	}
+	used, err := usedSubnets(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if used[ipNet.String()] {
+		return nil, fmt.Errorf("subnet %s is already in use", cidr)
+	}
+	return subnetAt(ipNet.IP.To4()), nil
+}
+
+// usedSubnets collects used subnets from both container state and live TAP
+// devices. Stale TAPs from crashed containers won't appear in state files,
+// so we also scan the host's network interfaces.
+func usedSubnets(rootDir string) (map[string]bool, error) {
 	used := make(map[string]bool)
 	ids, err := container.List(rootDir)
 	if err != nil {
@@ -43,40 +93,24 @@ func AllocateSubnet(rootDir string) (*Subnet, error) {
 	for _, cidr := range usedTAPSubnets() {
 		used[cidr] = true
 	}
+	return used, nil
+}
 
-	// Iterate /30 subnets within 10.0.0.0/16
-	// Each /30 gives us 4 IPs: network, host, guest, broadcast
-	// Start from 10.0.0.0/30, step by 4
-	base := net.ParseIP("10.0.0.0").To4()
-	for i := 0; i < 16384; i++ {
-		offset := uint32(i * 4)
-		networkIP := make(net.IP, 4)
-		copy(networkIP, base)
-		networkIP[2] = byte(offset >> 8)
-		networkIP[3] = byte(offset & 0xff)
-
-		cidr := fmt.Sprintf("%s/30", networkIP.String())
-		if used[cidr] {
-			continue
-		}
-
-		hostIP := make(net.IP, 4)
-		copy(hostIP, networkIP)
-		hostIP[3] += 1
+// subnetAt returns the host and guest addresses of the /30 at networkIP.
+func subnetAt(networkIP net.IP) *Subnet {
+	hostIP := make(net.IP, 4)
+	copy(hostIP, networkIP)
+	hostIP[3] += 1
 
-		guestIP := make(net.IP, 4)
-		copy(guestIP, networkIP)
-		guestIP[3] += 2
+	guestIP := make(net.IP, 4)
+	copy(guestIP, networkIP)
+	guestIP[3] += 2
 
-		logrus.Debugf("allocated subnet %s (host=%s, guest=%s)", cidr, hostIP, guestIP)
-		return &Subnet{
-			HostIP:  hostIP.String(),
-			GuestIP: guestIP.String(),
-			CIDR:    cidr,
-		}, nil
+	return &Subnet{
+		HostIP:  hostIP.String(),
+		GuestIP: guestIP.String(),
+		CIDR:    fmt.Sprintf("%s/30", networkIP.String()),
 	}
-
-	return nil, fmt.Errorf("no free /30 subnets available in 10.0.0.0/16")
 }
 
 // usedTAPSubnets returns the /30 CIDRs assigned to existing df-* TAP devices.
@@ -23,7 +23,23 @@ func Setup(ctr *container.Container) error {
 	if err != nil {
 		return fmt.Errorf("allocate subnet: %w", err)
 	}
+	return setupSubnet(ctr, subnet)
+}
+
+// SetupPreferring configures networking like Setup, but on the given /30
+// if it is free rather than the next free one.
+func SetupPreferring(ctr *container.Container, cidr string) error {
+	subnet, err := ReserveSubnet(ctr.RootDir, cidr)
+	if err != nil {
+		logrus.Debugf("%v, allocating another", err)
+		if subnet, err = AllocateSubnet(ctr.RootDir); err != nil {
+			return fmt.Errorf("allocate subnet: %w", err)
+		}
+	}
+	return setupSubnet(ctr, subnet)
+}
 
+func setupSubnet(ctr *container.Container, subnet *Subnet) error {
 	tapName := TAPName(ctr.ID)
 
 	// Create TAP device
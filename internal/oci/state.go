@@ -2,6 +2,7 @@ package oci
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/rorym/dock-fire/internal/container"
 )
@@ -15,16 +16,56 @@ type State struct {
 	Status     container.Status `json:"status"`
 	PID        int              `json:"pid,omitempty"`
 	Bundle     string           `json:"bundle"`
+	// Annotations carries the guest exit status once the container stops.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
+// Annotation keys for the guest exit status.
+const (
+	AnnotationExitCode   = "dock-fire/exit-code"
+	AnnotationExitSignal = "dock-fire/exit-signal"
+)
+
+// Annotation keys for live limits applied by update.
+const (
+	AnnotationLimitMemory   = "dock-fire/limit.memory"
+	AnnotationLimitDiskBps  = "dock-fire/limit.disk-bps"
+	AnnotationLimitDiskIOPS = "dock-fire/limit.disk-iops"
+	AnnotationLimitNetRxBps = "dock-fire/limit.net-rx-bps"
+	AnnotationLimitNetTxBps = "dock-fire/limit.net-tx-bps"
+)
+
 // MarshalState returns the JSON-encoded OCI state for a container.
 func MarshalState(c *container.Container) ([]byte, error) {
 	s := State{
 		OCIVersion: OCIVersion,
 		ID:         c.ID,
 		Status:     c.EffectiveStatus(),
-		PID:        c.PID,
+		PID:        c.ProcessPID(),
 		Bundle:     c.Bundle,
 	}
+	annotate := func(key, value string) {
+		if s.Annotations == nil {
+			s.Annotations = map[string]string{}
+		}
+		s.Annotations[key] = value
+	}
+	if c.ExitCode != nil {
+		annotate(AnnotationExitCode, strconv.Itoa(*c.ExitCode))
+		if c.ExitSignal != "" {
+			annotate(AnnotationExitSignal, c.ExitSignal)
+		}
+	}
+	for key, v := range map[string]int64{
+		AnnotationLimitMemory:   c.Limits.MemoryMiB << 20,
+		AnnotationLimitDiskBps:  c.Limits.DiskBps,
+		AnnotationLimitDiskIOPS: c.Limits.DiskIOPS,
+		AnnotationLimitNetRxBps: c.Limits.NetRxBps,
+		AnnotationLimitNetTxBps: c.Limits.NetTxBps,
+	} {
+		if v > 0 {
+			annotate(key, strconv.FormatInt(v, 10))
+		}
+	}
 	return json.MarshalIndent(s, "", "  ")
 }
@@ -0,0 +1,52 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// etcFiles are the files Docker generates for a container and bind mounts
+// over the image's own. A VM can't share them, so they are copied in.
+var etcFiles = map[string]bool{
+	"/etc/hosts":       true,
+	"/etc/hostname":    true,
+	"/etc/resolv.conf": true,
+}
+
+// copyEtcFiles writes the sources of the spec's bind mounts of etcFiles
+// over the same paths in the image mounted at root. What is there is
+// replaced, not written through, so a symlink such as a resolv.conf
+// pointing at systemd-resolved's stub goes too.
+func copyEtcFiles(root string, spec *specs.Spec) error {
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, m := range spec.Mounts {
+		dest := filepath.Clean(m.Destination)
+		if !isBind(m) || !etcFiles[dest] {
+			continue
+		}
+		data, err := os.ReadFile(m.Source)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", dest, err)
+		}
+		rel := strings.TrimPrefix(dest, "/")
+		if err := r.MkdirAll(filepath.Dir(rel), 0o755); err != nil {
+			return fmt.Errorf("mkdir %s: %w", filepath.Dir(dest), err)
+		}
+		if err := r.Remove(rel); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("replace %s: %w", dest, err)
+		}
+		if err := r.WriteFile(rel, data, 0o644); err != nil {
+			return fmt.Errorf("write %s: %w", dest, err)
+		}
+	}
+	return nil
+}
@@ -9,6 +9,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
 	"github.com/sirupsen/logrus"
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
@@ -20,18 +22,29 @@ type InitConfig struct {
 	Env      []string `json:"env"`
 	Cwd      string   `json:"cwd"`
 	Terminal bool     `json:"terminal,omitempty"`
+	// Hostname and Domainname are set in the guest kernel.
+	Hostname   string `json:"hostname,omitempty"`
+	Domainname string `json:"domainname,omitempty"`
+	// Mounts are filesystems init mounts before the volumes, in order.
+	Mounts []InitMount `json:"mounts,omitempty"`
+	// Volumes are mounted by init from the extra drives.
+	Volumes []InitVolume `json:"volumes,omitempty"`
+	// ReadonlyRoot keeps the root filesystem read-only.
+	ReadonlyRoot bool `json:"readonlyRoot,omitempty"`
+	// User is who the workload runs as.
+	User agent.User `json:"user"`
 }
 
 // CreateImage converts an OCI rootfs directory into an ext4 block device image.
-// It copies the rootfs contents, the dock-fire-init binary, and the init config.
-func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, error) {
+// It copies the rootfs contents, the dock-fire-init binary, and the init config,
+// which tells init where to mount volumes.
+func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec, volumes []container.Volume) (string, error) {
 	stateDir := filepath.Join(rootDir, id)
 	if err := os.MkdirAll(stateDir, 0o700); err != nil {
 		return "", fmt.Errorf("mkdir state dir: %w", err)
 	}
 
-	imagePath := filepath.Join(stateDir, "rootfs.ext4")
-	mountPoint := filepath.Join(stateDir, "mnt")
+	imagePath := ImagePath(rootDir, id)
 
 	// Calculate image size: rootfs + 20% padding for ext4 metadata
 	// (journal, inodes, group descriptors, bitmaps). Flat padding
@@ -46,7 +59,7 @@ func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, erro
 	// Images are sparse files, so a large minimum costs nothing until written.
 	minSize := int64(1024 * 1024 * 1024) // 1GB default
 	if v := os.Getenv("DOCK_FIRE_DISK_SIZE"); v != "" {
-		if parsed, err := parseSize(v); err == nil {
+		if parsed, err := ParseSize(v); err == nil {
 			minSize = parsed
 		} else {
 			logrus.Warnf("ignoring invalid DOCK_FIRE_DISK_SIZE=%q: %v", v, err)
@@ -54,7 +67,7 @@ func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, erro
 	}
 	if spec.Annotations != nil {
 		if v, ok := spec.Annotations["dock-fire/disk-size"]; ok {
-			if parsed, err := parseSize(v); err == nil {
+			if parsed, err := ParseSize(v); err == nil {
 				minSize = parsed
 			} else {
 				logrus.Warnf("ignoring invalid dock-fire/disk-size annotation %q: %v", v, err)
@@ -66,34 +79,25 @@ func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, erro
 	}
 	logrus.Debugf("rootfs size: %d bytes, image size: %d bytes (min: %d bytes)", rootfsSize, imageSize, minSize)
 
-	// Create sparse file
-	if err := exec.Command("truncate", "-s", fmt.Sprintf("%d", imageSize), imagePath).Run(); err != nil {
-		return "", fmt.Errorf("truncate: %w", err)
+	if err := formatImage(imagePath, imageSize); err != nil {
+		return "", err
 	}
-
-	// Format as ext4
-	mkfsOut, err := exec.Command("mkfs.ext4", "-q", "-F", imagePath).CombinedOutput()
+	mountPoint, err := mountImage(imagePath, false)
 	if err != nil {
-		return "", fmt.Errorf("mkfs.ext4: %w: %s", err, mkfsOut)
+		return "", err
 	}
-
-	// Mount
-	if err := os.MkdirAll(mountPoint, 0o755); err != nil {
-		return "", fmt.Errorf("mkdir mount point: %w", err)
-	}
-	if out, err := exec.Command("mount", "-o", "loop", imagePath, mountPoint).CombinedOutput(); err != nil {
-		return "", fmt.Errorf("mount: %w: %s", err, out)
-	}
-	defer func() {
-		exec.Command("umount", mountPoint).Run()
-		os.Remove(mountPoint)
-	}()
+	defer unmountImage(mountPoint)
 
 	// Copy rootfs contents
 	if out, err := exec.Command("cp", "-a", rootfsPath+"/.", mountPoint+"/").CombinedOutput(); err != nil {
 		return "", fmt.Errorf("cp rootfs: %w: %s", err, out)
 	}
 
+	// Docker's /etc/hosts, /etc/hostname and /etc/resolv.conf
+	if err := copyEtcFiles(mountPoint, spec); err != nil {
+		return "", err
+	}
+
 	// Copy dock-fire-init binary
 	initBin, err := findInitBinary()
 	if err != nil {
@@ -111,13 +115,23 @@ func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, erro
 	}
 
 	// Write init config
+	initVols, err := initVolumes(volumes)
+	if err != nil {
+		return "", err
+	}
 	initCfg := InitConfig{
-		Cwd: "/",
+		Cwd:          "/",
+		Mounts:       guestMounts(spec),
+		Volumes:      initVols,
+		ReadonlyRoot: spec.Root != nil && spec.Root.Readonly,
+		Hostname:     spec.Hostname,
+		Domainname:   spec.Domainname,
 	}
 	if spec.Process != nil {
 		initCfg.Args = spec.Process.Args
 		initCfg.Env = spec.Process.Env
 		initCfg.Terminal = spec.Process.Terminal
+		initCfg.User = agent.UserFromSpec(spec.Process.User)
 		if spec.Process.Cwd != "" {
 			initCfg.Cwd = spec.Process.Cwd
 		}
@@ -134,13 +148,82 @@ func CreateImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, erro
 		return "", fmt.Errorf("write init config: %w", err)
 	}
 
+	// A read-only root can't have mount points made at boot. Those under
+	// the kernel's filesystems are made by init on them.
+	for _, m := range initCfg.Mounts {
+		if !isKernelPath(m.Destination) {
+			makeMountPoint(mountPoint, m.Destination)
+		}
+	}
+	for _, v := range initCfg.Volumes {
+		makeMountPoint(mountPoint, v.Destination)
+	}
+
 	logrus.Debugf("created rootfs image at %s", imagePath)
 	return imagePath, nil
 }
 
-// parseSize parses a human-readable size string into bytes.
+// ImagePath returns where CreateImage puts the container's root image.
+func ImagePath(rootDir, id string) string {
+	return filepath.Join(rootDir, id, "rootfs.ext4")
+}
+
+// buildMountPoint is where an image is mounted while it is filled or read.
+func buildMountPoint(imagePath string) string {
+	return filepath.Join(filepath.Dir(imagePath), "mnt")
+}
+
+// formatImage creates a sparse file of size bytes at imagePath and formats
+// it as ext4.
+func formatImage(imagePath string, size int64) error {
+	if err := exec.Command("truncate", "-s", fmt.Sprintf("%d", size), imagePath).Run(); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", imagePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4: %w: %s", err, out)
+	}
+	return nil
+}
+
+// mountImage loop mounts imagePath at its build mount point.
+func mountImage(imagePath string, readOnly bool) (string, error) {
+	mountPoint := buildMountPoint(imagePath)
+	if err := os.MkdirAll(mountPoint, 0o755); err != nil {
+		return "", fmt.Errorf("mkdir mount point: %w", err)
+	}
+	opts := "loop"
+	if readOnly {
+		opts += ",ro"
+	}
+	if out, err := exec.Command("mount", "-o", opts, imagePath, mountPoint).CombinedOutput(); err != nil {
+		os.Remove(mountPoint)
+		return "", fmt.Errorf("mount: %w: %s", err, out)
+	}
+	return mountPoint, nil
+}
+
+func unmountImage(mountPoint string) {
+	exec.Command("umount", mountPoint).Run()
+	os.Remove(mountPoint)
+}
+
+// RemoveImage deletes an image made by CreateImage. An interrupted build
+// can leave the image mounted, so it is unmounted first.
+func RemoveImage(imagePath string) error {
+	mountPoint := buildMountPoint(imagePath)
+	if _, err := os.Stat(mountPoint); err == nil {
+		exec.Command("umount", mountPoint).Run()
+		os.Remove(mountPoint)
+	}
+	if err := os.Remove(imagePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove image: %w", err)
+	}
+	return nil
+}
+
+// ParseSize parses a human-readable size string into bytes.
 // Accepts plain bytes ("1073741824"), megabytes ("512M"), or gigabytes ("2G").
-func parseSize(s string) (int64, error) {
+func ParseSize(s string) (int64, error) {
 	s = strings.TrimSpace(s)
 	if s == "" {
 		return 0, fmt.Errorf("empty size string")
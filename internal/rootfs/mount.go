@@ -0,0 +1,81 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// InitMount is a filesystem init mounts, with options as in the spec.
+type InitMount struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// shmSize is the size of the tmpfs /dev/shm gets when its source can't
+// tell, Docker's default.
+const shmSize = 64 * 1024 * 1024
+
+// guestMounts returns the spec's mounts that init performs in the guest:
+// everything but bind mounts, which are volumes or files, and the tmpfs
+// Docker puts over /dev, which would hide the devices init needs. A bind
+// of a host tmpfs over /dev/shm, for shareable IPC, can't be shared with
+// a VM, so it becomes a tmpfs of the same size.
+func guestMounts(spec *specs.Spec) []InitMount {
+	var mounts []InitMount
+	for _, m := range spec.Mounts {
+		dest := filepath.Clean(m.Destination)
+		if dest == "/dev" {
+			continue
+		}
+		if isBind(m) {
+			if dest == "/dev/shm" {
+				mounts = append(mounts, shmMount(m.Source))
+			}
+			continue
+		}
+		mounts = append(mounts, InitMount{
+			Source:      m.Source,
+			Destination: m.Destination,
+			Type:        m.Type,
+			Options:     m.Options,
+		})
+	}
+	return mounts
+}
+
+// shmMount returns a tmpfs for /dev/shm as big as the host tmpfs at source.
+func shmMount(source string) InitMount {
+	size := int64(shmSize)
+	var st unix.Statfs_t
+	if err := unix.Statfs(source, &st); err == nil && st.Blocks > 0 {
+		size = int64(st.Blocks) * st.Bsize
+	}
+	return InitMount{
+		Source:      "shm",
+		Destination: "/dev/shm",
+		Type:        "tmpfs",
+		Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", fmt.Sprintf("size=%d", size)},
+	}
+}
+
+// makeMountPoint creates dest inside the image mounted at root. Symlinks in
+// the image are resolved within it, never on the host.
+func makeMountPoint(root, dest string) {
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		logrus.Warnf("create mount point %s: %v", dest, err)
+		return
+	}
+	defer r.Close()
+	if err := r.MkdirAll(strings.TrimPrefix(dest, "/"), 0o755); err != nil {
+		logrus.Warnf("create mount point %s: %v", dest, err)
+	}
+}
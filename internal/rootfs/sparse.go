@@ -0,0 +1,93 @@
+package rootfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopySparse copies src to dst, skipping holes so that sparse images stay
+// sparse.
+func CopySparse(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(fi.Size()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := copyData(in, out, fi.Size()); err != nil {
+		out.Close()
+		return fmt.Errorf("copy %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// OverlaySparse writes the data regions of src over the same offsets in dst,
+// leaving the rest of dst untouched. This merges a Firecracker diff snapshot
+// onto the memory file of its parent.
+func OverlaySparse(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := copyData(in, out, fi.Size()); err != nil {
+		out.Close()
+		return fmt.Errorf("overlay %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// copyData copies every data region of in to the same offset in out.
+func copyData(in, out *os.File, size int64) error {
+	fd := int(in.Fd())
+	var off int64
+	for off < size {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// No data past off
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		if _, err := in.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, in, end-start); err != nil {
+			return err
+		}
+		off = end
+	}
+	return nil
+}
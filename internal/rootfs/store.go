@@ -0,0 +1,124 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultVolumeDir is where named volumes are kept unless
+// DOCK_FIRE_VOLUME_DIR says otherwise.
+const DefaultVolumeDir = "/var/lib/dock-fire/volumes"
+
+// volumeAnnotation prefixes the annotations that attach named volumes:
+// dock-fire/volume.<name>=<destination>[:size][:ro]
+const volumeAnnotation = "dock-fire/volume."
+
+var volumeNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// VolumeDir returns the named volume store directory.
+func VolumeDir() string {
+	if d := os.Getenv("DOCK_FIRE_VOLUME_DIR"); d != "" {
+		return d
+	}
+	return DefaultVolumeDir
+}
+
+// NamedVolumes returns the named volumes selected by the spec's
+// annotations, sorted by name, creating the image of any that doesn't
+// exist yet. Their images outlive the container.
+func NamedVolumes(spec *specs.Spec) ([]container.Volume, error) {
+	var names []string
+	for k := range spec.Annotations {
+		if strings.HasPrefix(k, volumeAnnotation) {
+			names = append(names, strings.TrimPrefix(k, volumeAnnotation))
+		}
+	}
+	sort.Strings(names)
+
+	var vols []container.Volume
+	for _, name := range names {
+		value := spec.Annotations[volumeAnnotation+name]
+		if !volumeNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid volume name %q", name)
+		}
+		dest, size, readOnly, err := parseVolumeAnnotation(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s%s: %w", volumeAnnotation, name, err)
+		}
+		dir := VolumeDir()
+		v := container.Volume{
+			Name:        name,
+			Destination: dest,
+			Image:       filepath.Join(dir, name+".ext4"),
+			Lock:        filepath.Join(dir, name+".lock"),
+			ReadOnly:    readOnly,
+		}
+		if err := ensureVolumeImage(v.Image, size); err != nil {
+			return nil, fmt.Errorf("volume %s: %w", name, err)
+		}
+		vols = append(vols, v)
+	}
+	return vols, nil
+}
+
+// parseVolumeAnnotation splits "<destination>[:size][:ro]".
+func parseVolumeAnnotation(value string) (dest string, size int64, readOnly bool, err error) {
+	parts := strings.Split(value, ":")
+	dest, parts = parts[0], parts[1:]
+	if !filepath.IsAbs(dest) {
+		return "", 0, false, fmt.Errorf("destination %q is not an absolute path", dest)
+	}
+	if n := len(parts); n > 0 && parts[n-1] == "ro" {
+		readOnly = true
+		parts = parts[:n-1]
+	}
+	size = DefaultVolumeSize
+	switch len(parts) {
+	case 0:
+	case 1:
+		if size, err = ParseSize(parts[0]); err != nil {
+			return "", 0, false, err
+		}
+		if size <= 0 {
+			return "", 0, false, fmt.Errorf("invalid size %q", parts[0])
+		}
+	default:
+		return "", 0, false, fmt.Errorf("%q is not <destination>[:size][:ro]", value)
+	}
+	return dest, size, readOnly, nil
+}
+
+// ensureVolumeImage creates an empty ext4 image at path if there is none.
+// It is built under a temporary name and linked into place, so a create
+// that is killed or races another never leaves a half-made volume.
+func ensureVolumeImage(path string, size int64) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("mkdir volume dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := formatImage(tmp.Name(), size); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("create volume image: %w", err)
+	}
+	logrus.Debugf("created volume image %s (%d bytes)", path, size)
+	return nil
+}
@@ -0,0 +1,221 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultVolumeSize is the smallest image built for a bind mount, and the
+// size of a new named volume. Like the root image they are sparse, so they
+// only cost what is written.
+const DefaultVolumeSize = 1024 * 1024 * 1024
+
+// maxVolumes keeps guest device names within /dev/vdb to /dev/vdz.
+const maxVolumes = 25
+
+// InitVolume is a volume as the guest sees it: the drive to mount and where.
+type InitVolume struct {
+	Device      string `json:"device"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+}
+
+// BindVolumes returns the bind mounts in spec that become extra drives: a
+// host directory is copied into an image in the state directory, and a
+// block device is passed through. Other sources, and mounts of the guest's
+// own /dev, /proc and /sys, are left out.
+func BindVolumes(rootDir, id string, spec *specs.Spec) []container.Volume {
+	var vols []container.Volume
+	for _, m := range spec.Mounts {
+		if !isBind(m) || isKernelPath(m.Destination) {
+			continue
+		}
+		fi, err := os.Stat(m.Source)
+		if err != nil {
+			logrus.Warnf("skipping bind mount %s: %v", m.Destination, err)
+			continue
+		}
+		v := container.Volume{
+			Source:      m.Source,
+			Destination: m.Destination,
+			ReadOnly:    slices.Contains(m.Options, "ro"),
+		}
+		switch {
+		case fi.IsDir():
+			v.Image = filepath.Join(rootDir, id, "volumes", strconv.Itoa(len(vols)), "volume.ext4")
+		case fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0:
+		default:
+			logrus.Debugf("skipping bind mount %s: not a directory or block device", m.Destination)
+			continue
+		}
+		vols = append(vols, v)
+	}
+	return vols
+}
+
+// BuildVolumeImage creates v's drive image from its source directory. A
+// volume without an image needs nothing built.
+func BuildVolumeImage(v container.Volume) error {
+	if v.Image == "" {
+		return nil
+	}
+	size, err := dirSize(v.Source)
+	if err != nil {
+		return fmt.Errorf("calculate size of %s: %w", v.Source, err)
+	}
+	size = max(size+size/5, DefaultVolumeSize)
+
+	if err := os.MkdirAll(filepath.Dir(v.Image), 0o700); err != nil {
+		return fmt.Errorf("mkdir volume dir: %w", err)
+	}
+	if err := formatImage(v.Image, size); err != nil {
+		return err
+	}
+	mountPoint, err := mountImage(v.Image, false)
+	if err != nil {
+		return err
+	}
+	defer unmountImage(mountPoint)
+
+	if out, err := exec.Command("cp", "-a", v.Source+"/.", mountPoint+"/").CombinedOutput(); err != nil {
+		return fmt.Errorf("cp %s: %w: %s", v.Source, err, out)
+	}
+	logrus.Debugf("created volume image %s from %s", v.Image, v.Source)
+	return nil
+}
+
+// LockSources takes an exclusive lock on the host directory of each
+// writable bind volume, so a second container can't attach it read-write
+// while this one's changes are still to be synced back. The locks last for
+// as long as any process holds the returned files open; the monitor keeps
+// them until it has synced. Read-only binds take no lock.
+func LockSources(vols []container.Volume) ([]*os.File, error) {
+	var locks []*os.File
+	locked := make(map[string]bool)
+	for _, v := range vols {
+		if v.Image == "" || v.Source == "" || v.ReadOnly {
+			continue
+		}
+		src := filepath.Clean(v.Source)
+		if locked[src] {
+			continue
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			UnlockSources(locks)
+			return nil, fmt.Errorf("open %s: %w", src, err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			UnlockSources(locks)
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, fmt.Errorf("%s is bind mounted read-write by another container", src)
+			}
+			return nil, fmt.Errorf("lock %s: %w", src, err)
+		}
+		locked[src] = true
+		locks = append(locks, f)
+	}
+	return locks, nil
+}
+
+// UnlockSources releases locks taken by LockSources.
+func UnlockSources(locks []*os.File) {
+	for _, f := range locks {
+		f.Close()
+	}
+}
+
+// SyncVolumes copies what the guest wrote to writable directory volumes
+// back to their host directories. It is for once the VM has exited. Named
+// volumes keep their data in their images.
+func SyncVolumes(vols []container.Volume) error {
+	var errs []string
+	for _, v := range vols {
+		if !synced(v) {
+			continue
+		}
+		if err := syncVolume(v); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("sync volumes: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// HasSyncedVolumes reports whether any of vols is copied back to the host
+// by SyncVolumes.
+func HasSyncedVolumes(vols []container.Volume) bool {
+	for _, v := range vols {
+		if synced(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func synced(v container.Volume) bool {
+	return v.Image != "" && v.Source != "" && !v.ReadOnly
+}
+
+func syncVolume(v container.Volume) error {
+	mountPoint, err := mountImage(v.Image, true)
+	if err != nil {
+		return err
+	}
+	defer unmountImage(mountPoint)
+
+	out, err := exec.Command("rsync", "-a", "--delete", "--exclude", "/lost+found",
+		mountPoint+"/", v.Source+"/").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rsync to %s: %w: %s", v.Source, err, out)
+	}
+	logrus.Debugf("synced volume %s back to %s", v.Image, v.Source)
+	return nil
+}
+
+// initVolumes numbers the volumes' drives as the guest sees them: the root
+// drive is always /dev/vda and the rest follow in the order attached.
+func initVolumes(vols []container.Volume) ([]InitVolume, error) {
+	if len(vols) > maxVolumes {
+		return nil, fmt.Errorf("%d volumes given, at most %d are supported", len(vols), maxVolumes)
+	}
+	out := make([]InitVolume, 0, len(vols))
+	for i, v := range vols {
+		out = append(out, InitVolume{
+			Device:      fmt.Sprintf("/dev/vd%c", 'b'+i),
+			Destination: v.Destination,
+			ReadOnly:    v.ReadOnly,
+		})
+	}
+	return out, nil
+}
+
+func isBind(m specs.Mount) bool {
+	return m.Type == "bind" || slices.Contains(m.Options, "bind") || slices.Contains(m.Options, "rbind")
+}
+
+// isKernelPath reports whether dest is under a filesystem the guest kernel
+// provides itself.
+func isKernelPath(dest string) bool {
+	dest = filepath.Clean(dest)
+	for _, p := range []string{"/dev", "/proc", "/sys"} {
+		if dest == p || strings.HasPrefix(dest, p+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Files written to a checkpoint image directory.
+const (
+	checkpointMemFile   = "memory"
+	checkpointStateFile = "vmstate"
+	checkpointRootfs    = "rootfs.ext4"
+	checkpointMetaFile  = "checkpoint.json"
+)
+
+// checkpointMeta records what restore needs to rebuild the VM's host side.
+// The snapshot bakes in the drive, TAP and vsock paths and the guest's IP
+// configuration, so restore has to recreate them exactly.
+type checkpointMeta struct {
+	ID           string    `json:"id"`
+	Created      time.Time `json:"created"`
+	SnapshotType string    `json:"snapshotType"`
+	Parent       string    `json:"parent,omitempty"`
+	ImagePath    string    `json:"imagePath"`
+	VsockPath    string    `json:"vsockPath"`
+	TapDevice    string    `json:"tapDevice,omitempty"`
+	SubnetCIDR   string    `json:"subnetCIDR,omitempty"`
+}
+
+// criuFlags are checkpoint/restore options containerd passes through for
+// runc. They have no meaning for a VM snapshot and are accepted and ignored.
+func criuFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "work-path", Hidden: true},
+		&cli.BoolFlag{Name: "tcp-established", Hidden: true},
+		&cli.BoolFlag{Name: "ext-unix-sk", Hidden: true},
+		&cli.BoolFlag{Name: "shell-job", Hidden: true},
+		&cli.BoolFlag{Name: "file-locks", Hidden: true},
+		&cli.StringFlag{Name: "manage-cgroups-mode", Hidden: true},
+		&cli.StringSliceFlag{Name: "empty-ns", Hidden: true},
+		&cli.BoolFlag{Name: "auto-dedup", Hidden: true},
+		&cli.BoolFlag{Name: "lazy-pages", Hidden: true},
+	}
+}
+
+var CheckpointCommand = &cli.Command{
+	Name:  "checkpoint",
+	Usage: "checkpoint a running container",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is your name for the instance of the container.
+The VM is paused and its memory, device state and root filesystem are
+written to --image-path.`,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "image-path",
+			Usage: "path for saving the snapshot files",
+		},
+		&cli.StringFlag{
+			Name:  "parent-path",
+			Usage: "path of the previous checkpoint of this container, for an incremental snapshot",
+		},
+		&cli.BoolFlag{
+			Name:  "leave-running",
+			Usage: "leave the container running after checkpoint",
+		},
+		&cli.BoolFlag{
+			Name:  "pre-dump",
+			Usage: "take a snapshot without stopping the container (implies --leave-running)",
+		},
+	}, criuFlags()...),
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		imageDir := c.String("image-path")
+		if imageDir == "" {
+			return fmt.Errorf("--image-path is required")
+		}
+		imageDir, err := filepath.Abs(imageDir)
+		if err != nil {
+			return err
+		}
+		leaveRunning := c.Bool("leave-running") || c.Bool("pre-dump")
+		rootDir := c.String("root")
+
+		logrus.Debugf("checkpoint: id=%s image-path=%s", id, imageDir)
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		status := ctr.EffectiveStatus()
+		if status != container.Running && status != container.Paused {
+			return fmt.Errorf("container %q is not running (status: %s)", id, status)
+		}
+		// A restored VM would come back without its volume drives
+		if len(ctr.Volumes) > 0 {
+			return fmt.Errorf("container %q has volumes, which checkpoint does not support", id)
+		}
+
+		if err := os.MkdirAll(imageDir, 0o700); err != nil {
+			return fmt.Errorf("create image dir: %w", err)
+		}
+
+		meta := checkpointMeta{
+			ID:           ctr.ID,
+			Created:      time.Now().UTC(),
+			SnapshotType: "Full",
+			ImagePath:    ctr.ImagePath,
+			VsockPath:    ctr.VsockPath,
+			TapDevice:    ctr.TapDevice,
+			SubnetCIDR:   ctr.SubnetCIDR,
+		}
+		parent := c.String("parent-path")
+		if parent != "" {
+			if parent, err = filepath.Abs(parent); err != nil {
+				return err
+			}
+			// Dirty pages are only tracked since this VM's last snapshot, so
+			// any other parent would be missing changes.
+			if parent == ctr.LastCheckpoint {
+				meta.SnapshotType = "Diff"
+				meta.Parent = parent
+			} else {
+				logrus.Warnf("checkpoint %s: %s is not the last checkpoint of this VM, taking a full snapshot", id, parent)
+			}
+		}
+
+		if status == container.Running {
+			if err := vm.Pause(ctr); err != nil {
+				return fmt.Errorf("pause container %q: %w", id, err)
+			}
+		}
+		if err := writeCheckpoint(ctr, imageDir, &meta); err != nil {
+			if status == container.Running {
+				if rerr := vm.Resume(ctr); rerr != nil {
+					logrus.Warnf("resume container %s after failed checkpoint: %v", id, rerr)
+				}
+			}
+			return fmt.Errorf("checkpoint container %q: %w", id, err)
+		}
+
+		ctr.LastCheckpoint = imageDir
+		if err := ctr.Save(); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+
+		if !leaveRunning {
+			// The monitor sees the VM go and records the container as stopped
+			if err := stopVM(ctr); err != nil {
+				logrus.Warnf("failed to stop VMM: %v", err)
+			}
+		} else if status == container.Running {
+			if err := vm.Resume(ctr); err != nil {
+				return fmt.Errorf("resume container %q: %w", id, err)
+			}
+		}
+
+		logrus.Infof("container %s checkpointed to %s (%s snapshot)", id, imageDir, meta.SnapshotType)
+		return nil
+	},
+}
+
+// writeCheckpoint snapshots the paused VM into dir along with a copy of its
+// root filesystem and the metadata restore needs.
+func writeCheckpoint(ctr *container.Container, dir string, meta *checkpointMeta) error {
+	memPath := filepath.Join(dir, checkpointMemFile)
+	statePath := filepath.Join(dir, checkpointStateFile)
+
+	if meta.Parent == "" {
+		if err := vm.Snapshot(ctr, memPath, statePath, false); err != nil {
+			return err
+		}
+	} else {
+		// Firecracker writes only the dirty pages of a diff snapshot. Lay
+		// them over a copy of the parent's memory so the checkpoint can be
+		// restored on its own.
+		diffPath := memPath + ".diff"
+		if err := vm.Snapshot(ctr, diffPath, statePath, true); err != nil {
+			return err
+		}
+		defer os.Remove(diffPath)
+		if err := rootfs.CopySparse(filepath.Join(meta.Parent, checkpointMemFile), memPath); err != nil {
+			return fmt.Errorf("copy parent memory: %w", err)
+		}
+		if err := rootfs.OverlaySparse(diffPath, memPath); err != nil {
+			return fmt.Errorf("merge diff snapshot: %w", err)
+		}
+	}
+
+	if err := rootfs.CopySparse(ctr.ImagePath, filepath.Join(dir, checkpointRootfs)); err != nil {
+		return fmt.Errorf("copy rootfs image: %w", err)
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal checkpoint metadata: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, checkpointMetaFile), data, 0o600); err != nil {
+		return fmt.Errorf("write checkpoint metadata: %w", err)
+	}
+	return nil
+}
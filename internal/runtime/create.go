@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/rorym/dock-fire/internal/cgroup"
 	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/network"
 	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -42,86 +47,185 @@ Where "<container-id>" is your name for the instance of the container.`,
 		if id == "" {
 			return fmt.Errorf("container ID is required")
 		}
-		bundle := c.String("bundle")
-		rootDir := c.String("root")
-		pidFile := c.String("pid-file")
-
-		// Make bundle path absolute
-		if !filepath.IsAbs(bundle) {
-			cwd, err := os.Getwd()
-			if err != nil {
-				return fmt.Errorf("getwd: %w", err)
-			}
-			bundle = filepath.Join(cwd, bundle)
-		}
-
-		logrus.Debugf("create: id=%s bundle=%s root=%s", id, bundle, rootDir)
-
-		if container.Exists(rootDir, id) {
-			return fmt.Errorf("container %q already exists", id)
-		}
 
-		// Parse OCI config
-		spec, err := oci.LoadConfig(bundle)
+		ctr, err := createContainer(c, id)
 		if err != nil {
-			return fmt.Errorf("load OCI config: %w", err)
-		}
-		logrus.Debugf("parsed OCI spec, process args: %v", spec.Process.Args)
-
-		// Create container in "creating" state
-		ctr := &container.Container{
-			ID:      id,
-			Bundle:  bundle,
-			Status:  container.Creating,
-			RootDir: rootDir,
+			return err
 		}
 
-		// Build ext4 rootfs image
-		rootfsPath := filepath.Join(bundle, "rootfs")
-		if spec.Root != nil && spec.Root.Path != "" {
-			rp := spec.Root.Path
-			if filepath.IsAbs(rp) {
-				rootfsPath = rp
-			} else {
-				rootfsPath = filepath.Join(bundle, rp)
-			}
+		// Write PID file with the monitor process PID
+		if err := writePidFile(c.String("pid-file"), ctr.ProcessPID()); err != nil {
+			return err
 		}
 
-		imagePath, err := createRootfsImage(rootDir, id, rootfsPath, spec)
+		logrus.Infof("container %s created (VMM PID: %d, monitor PID: %d)", id, ctr.PID, ctr.MonitorPID)
+		return nil
+	},
+}
+
+// createContainer builds the rootfs image and network for the bundle named
+// by --bundle, boots the VM with the workload held, and saves the container
+// in the created state. Each resource is recorded in an undo journal first,
+// and everything is released again if create fails.
+func createContainer(c *cli.Context, id string) (_ *container.Container, retErr error) {
+	bundle := c.String("bundle")
+	rootDir := c.String("root")
+
+	// Make bundle path absolute
+	if !filepath.IsAbs(bundle) {
+		cwd, err := os.Getwd()
 		if err != nil {
-			return fmt.Errorf("create rootfs image: %w", err)
+			return nil, fmt.Errorf("getwd: %w", err)
 		}
-		ctr.ImagePath = imagePath
-
-		// Set up networking
-		if err := setupNetworking(ctr); err != nil {
-			return fmt.Errorf("setup networking: %w", err)
+		bundle = filepath.Join(cwd, bundle)
+	}
+
+	logrus.Debugf("create: id=%s bundle=%s root=%s", id, bundle, rootDir)
+
+	if container.Exists(rootDir, id) {
+		return nil, fmt.Errorf("container %q already exists", id)
+	}
+	// A create that was killed partway leaves its journal behind
+	if err := rollbackCreate(rootDir, id); err != nil {
+		return nil, fmt.Errorf("roll back earlier create: %w", err)
+	}
+
+	// Parse OCI config
+	spec, err := oci.LoadConfig(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("load OCI config: %w", err)
+	}
+	logrus.Debugf("parsed OCI spec, process args: %v", spec.Process.Args)
+
+	// Create container in "creating" state
+	ctr := &container.Container{
+		ID:      id,
+		Bundle:  bundle,
+		Status:  container.Creating,
+		RootDir: rootDir,
+		Created: time.Now().UTC(),
+
+		SystemdCgroup: c.Bool("systemd-cgroup"),
+	}
+
+	journal := container.NewJournal(rootDir, id)
+	if err := journal.Record(container.UndoEntry{Kind: container.UndoStateDir, Path: filepath.Join(rootDir, id)}); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := rollbackCreate(rootDir, id); err != nil {
+				logrus.Warnf("container %s: rollback: %v", id, err)
+			}
 		}
-
-		// Boot the VM now so we have a valid PID for containerd.
-		// The guest init will run the user command immediately.
-		consoleSocket := c.String("console-socket")
-		if err := startVM(ctr, spec, consoleSocket); err != nil {
-			return fmt.Errorf("start VM: %w", err)
+	}()
+
+	// Build ext4 rootfs image
+	rootfsPath := filepath.Join(bundle, "rootfs")
+	if spec.Root != nil && spec.Root.Path != "" {
+		rp := spec.Root.Path
+		if filepath.IsAbs(rp) {
+			rootfsPath = rp
+		} else {
+			rootfsPath = filepath.Join(bundle, rp)
 		}
-
-		// Transition directly to running since the VM is started
-		if err := ctr.Transition(container.Created); err != nil {
-			return fmt.Errorf("transition to created: %w", err)
+	}
+
+	// Bind mounts of host directories are copied into images of their own.
+	// The writable ones stay locked until the monitor has synced them back.
+	ctr.Volumes = rootfs.BindVolumes(rootDir, id, spec)
+	sourceLocks, err := rootfs.LockSources(ctr.Volumes)
+	if err != nil {
+		return nil, err
+	}
+	defer rootfs.UnlockSources(sourceLocks)
+	for _, v := range ctr.Volumes {
+		if v.Image == "" {
+			continue
 		}
-		if err := ctr.Save(); err != nil {
-			return fmt.Errorf("save state: %w", err)
+		if err := journal.Record(container.UndoEntry{Kind: container.UndoImage, Path: v.Image}); err != nil {
+			return nil, err
 		}
-
-		// Write PID file with the VMM process PID
-		if pidFile != "" {
-			pid := fmt.Sprintf("%d", ctr.PID)
-			if err := os.WriteFile(pidFile, []byte(pid), 0o644); err != nil {
-				return fmt.Errorf("write pid file: %w", err)
-			}
+		if err := rootfs.BuildVolumeImage(v); err != nil {
+			return nil, fmt.Errorf("create volume %s: %w", v.Destination, err)
 		}
-
-		logrus.Infof("container %s created (VMM PID: %d)", id, ctr.PID)
-		return nil
-	},
+	}
+	// Named volumes are kept in the volume store, not released on failure
+	named, err := rootfs.NamedVolumes(spec)
+	if err != nil {
+		return nil, err
+	}
+	ctr.Volumes = append(ctr.Volumes, named...)
+
+	if err := journal.Record(container.UndoEntry{Kind: container.UndoImage, Path: rootfs.ImagePath(rootDir, id)}); err != nil {
+		return nil, err
+	}
+	imagePath, err := createRootfsImage(rootDir, id, rootfsPath, spec, ctr.Volumes)
+	if err != nil {
+		return nil, fmt.Errorf("create rootfs image: %w", err)
+	}
+	ctr.ImagePath = imagePath
+
+	// Set up networking. It is recorded afterwards: the subnet isn't known
+	// before, and setup removes its own TAP if it fails, which may be
+	// because another container's TAP has the same name.
+	if err := setupNetworking(ctr); err != nil {
+		return nil, fmt.Errorf("setup networking: %w", err)
+	}
+	if err := journal.Record(container.UndoEntry{Kind: container.UndoNetwork, TAP: ctr.TapDevice, Subnet: ctr.SubnetCIDR}); err != nil {
+		network.Teardown(ctr)
+		return nil, err
+	}
+
+	// The VMM is moved into its cgroup while it starts. The cgroup is
+	// recorded first and goes after the VMM when unwinding, once empty.
+	if err := cgroup.Resolve(ctr, spec); err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	if err := journal.Record(container.UndoEntry{Kind: container.UndoCgroup, Path: ctr.CgroupPath, Unit: ctr.CgroupUnit}); err != nil {
+		return nil, err
+	}
+
+	// Boot the VM now so we have a valid PID for containerd.
+	// The guest init holds the user command until start.
+	apiSocket, vsock := vm.SocketPaths(id)
+	sockets := []string{apiSocket, vsock}
+	if err := journal.Record(container.UndoEntry{Kind: container.UndoVM, Sockets: sockets}); err != nil {
+		return nil, err
+	}
+	consoleSocket := c.String("console-socket")
+	if err := startVM(ctr, spec, consoleSocket); err != nil {
+		return nil, fmt.Errorf("start VM: %w", err)
+	}
+	if err := journal.Record(container.UndoEntry{Kind: container.UndoVM, PID: ctr.PID, Sockets: sockets}); err != nil {
+		stopVM(ctr)
+		return nil, err
+	}
+
+	// Start the monitor that collects the main process's exit status.
+	// containerd waits on its PID rather than the VMM's. It exits by
+	// itself once the VM is gone.
+	if err := startMonitor(c, ctr, spec.Process != nil && spec.Process.Terminal, sourceLocks); err != nil {
+		return nil, fmt.Errorf("start monitor: %w", err)
+	}
+	// The monitor's PID is the one containerd reads the cgroup from
+	if err := cgroup.AddProcess(ctr, ctr.MonitorPID); err != nil {
+		logrus.Warnf("container %s: %v", id, err)
+	}
+
+	if err := vm.RunCreateHooks(ctr, spec.Hooks); err != nil {
+		return nil, err
+	}
+
+	if err := ctr.Transition(container.Created); err != nil {
+		return nil, fmt.Errorf("transition to created: %w", err)
+	}
+	if err := ctr.Save(); err != nil {
+		return nil, fmt.Errorf("save state: %w", err)
+	}
+	// From here delete releases the resources through the saved state
+	if err := journal.Commit(); err != nil {
+		logrus.Warnf("container %s: %v", id, err)
+	}
+	return ctr, nil
 }
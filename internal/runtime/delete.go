@@ -3,8 +3,13 @@ package runtime
 import (
 	"fmt"
 	"os"
+	"time"
+	"github.com/rorym/dock-fire/internal/cgroup"
 	"github.com/rorym/dock-fire/internal/container"
 	"github.com/rorym/dock-fire/internal/network"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -34,39 +39,79 @@ Where "<container-id>" is your name for the instance of the container.`,
 		ctr, err := container.Load(rootDir, id)
 		if err != nil {
 			if force {
-				// Force delete: just remove the state dir even if state can't be loaded
+				// Force delete: a create that was killed partway has no
+				// state yet, only its undo journal. Unwind that, then
+				// remove the state dir whatever is left in it.
+				if err := rollbackCreate(rootDir, id); err != nil {
+					logrus.Warnf("container %s: rollback: %v", id, err)
+				}
 				return container.Delete(rootDir, id)
 			}
 			return err
 		}
 
-		// If the VMM is still alive, either force-kill or error.
-		// The VM runs from the create phase, so check in both created and running states.
-		if ctr.IsVMMAlive() {
-			if !force {
-				return fmt.Errorf("container %q has a running VM, use --force to delete", id)
-			}
-			if err := stopVM(ctr); err != nil {
-				logrus.Warnf("failed to stop VMM: %v", err)
-			}
+		if err := deleteContainer(ctr, force); err != nil {
+			return err
 		}
 
-		// Clean up networking
-		if err := network.Teardown(ctr); err != nil {
-			logrus.Warnf("failed to tear down networking: %v", err)
-		}
+		logrus.Infof("container %s deleted", id)
+		return nil
+	},
+}
 
-		// Clean up socket file
-		if ctr.SocketPath != "" {
-			os.Remove(ctr.SocketPath)
-		}
+// volumeSyncTimeout bounds how long delete waits for the monitor to copy
+// bind volumes back to the host.
+const volumeSyncTimeout = 10 * time.Minute
 
-		// Remove state directory and all artifacts
-		if err := container.Delete(rootDir, id); err != nil {
-			return fmt.Errorf("delete state: %w", err)
+// deleteContainer releases everything the container holds on the host. A
+// live VM is only stopped when force is set.
+func deleteContainer(ctr *container.Container, force bool) error {
+	// If the VMM is still alive, either force-kill or error.
+	// The VM runs from the create phase, so check in both created and running states.
+	if ctr.IsVMMAlive() {
+		if !force {
+			return fmt.Errorf("container %q has a running VM, use --force to delete", ctr.ID)
 		}
+		if err := stopVM(ctr); err != nil {
+			logrus.Warnf("failed to stop VMM: %v", err)
+		}
+	}
+	// Let the monitor record the exit before the state goes, or it
+	// would write it back afterwards. While it copies bind volumes back
+	// their images must stay, so that wait is longer and must finish.
+	if rootfs.HasSyncedVolumes(ctr.Volumes) {
+		if !waitMonitor(ctr, volumeSyncTimeout) {
+			return fmt.Errorf("container %q is still syncing its volumes (monitor PID %d), try again later", ctr.ID, ctr.MonitorPID)
+		}
+	} else if !waitMonitor(ctr, vmmExitTimeout) {
+		logrus.Warnf("container %s: monitor (PID %d) still running", ctr.ID, ctr.MonitorPID)
+	}
 
-		logrus.Infof("container %s deleted", id)
-		return nil
-	},
+	if err := cgroup.Remove(ctr); err != nil {
+		logrus.Warnf("failed to remove cgroup: %v", err)
+	}
+
+	// Clean up networking
+	if err := network.Teardown(ctr); err != nil {
+		logrus.Warnf("failed to tear down networking: %v", err)
+	}
+
+	// Clean up socket files
+	if ctr.SocketPath != "" {
+		os.Remove(ctr.SocketPath)
+	}
+	if ctr.VsockPath != "" {
+		os.Remove(ctr.VsockPath)
+	}
+
+	// The bundle may already be gone; poststop hooks are best effort
+	if spec, err := oci.LoadConfig(ctr.Bundle); err == nil && spec.Hooks != nil {
+		vm.RunPostHooks(ctr, "poststop", spec.Hooks.Poststop)
+	}
+
+	// Remove state directory and all artifacts
+	if err := container.Delete(ctr.RootDir, ctr.ID); err != nil {
+		return fmt.Errorf("delete state: %w", err)
+	}
+	return nil
 }
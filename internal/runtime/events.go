@@ -0,0 +1,255 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// event is one line of events output, in the same shape as runc's.
+type event struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// stats mirrors the runc stats types for the fields a VM can fill in, plus
+// VM-specific counters under "vm".
+type stats struct {
+	CPU               cpuStats            `json:"cpu"`
+	Memory            memoryStats         `json:"memory"`
+	Pids              pidsStats           `json:"pids"`
+	Blkio             blkioStats          `json:"blkio"`
+	NetworkInterfaces []*networkInterface `json:"network_interfaces,omitempty"`
+	VM                vmStats             `json:"vm"`
+}
+
+type cpuStats struct {
+	Usage cpuUsage `json:"usage,omitempty"`
+}
+
+type cpuUsage struct {
+	Total  uint64 `json:"total,omitempty"`
+	Kernel uint64 `json:"kernel"`
+	User   uint64 `json:"user"`
+}
+
+type memoryStats struct {
+	Cache uint64      `json:"cache,omitempty"`
+	Usage memoryEntry `json:"usage,omitempty"`
+}
+
+type memoryEntry struct {
+	Limit   uint64 `json:"limit"`
+	Usage   uint64 `json:"usage,omitempty"`
+	Failcnt uint64 `json:"failcnt"`
+}
+
+type pidsStats struct {
+	Current uint64 `json:"current,omitempty"`
+}
+
+type blkioStats struct {
+	IoServiceBytesRecursive []blkioEntry `json:"ioServiceBytesRecursive,omitempty"`
+	IoServicedRecursive     []blkioEntry `json:"ioServicedRecursive,omitempty"`
+}
+
+type blkioEntry struct {
+	Major uint64 `json:"major,omitempty"`
+	Minor uint64 `json:"minor,omitempty"`
+	Op    string `json:"op,omitempty"`
+	Value uint64 `json:"value,omitempty"`
+}
+
+type networkInterface struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+type vmStats struct {
+	VcpuExits   uint64 `json:"vcpu_exits"`
+	VmmRSS      uint64 `json:"vmm_rss"`
+	BalloonMiB  int64  `json:"balloon_mib,omitempty"`
+	MajorFaults int64  `json:"major_faults,omitempty"`
+	MinorFaults int64  `json:"minor_faults,omitempty"`
+}
+
+var EventsCommand = &cli.Command{
+	Name:  "events",
+	Usage: "display container events such as OOM notifications, exits and resource stats",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is your name for the instance of the container.`,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "interval",
+			Value: 5 * time.Second,
+			Usage: "set the stats collection interval",
+		},
+		&cli.BoolFlag{
+			Name:  "stats",
+			Usage: "display the container's stats then exit",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		interval := c.Duration("interval")
+		if interval <= 0 {
+			return fmt.Errorf("duration interval must be greater than 0")
+		}
+		rootDir := c.String("root")
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		status := ctr.EffectiveStatus()
+		if status == container.Stopped {
+			return fmt.Errorf("container %q is not running (status: %s)", id, status)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		if c.Bool("stats") {
+			s, _, err := collectStats(ctr, status)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(event{Type: "stats", ID: id, Data: s})
+		}
+
+		var lastOOM uint64
+		first := true
+		for {
+			ctr, err = container.Load(rootDir, id)
+			if err != nil {
+				return err
+			}
+			cur := ctr.EffectiveStatus()
+			if cur == container.Stopped {
+				data := map[string]interface{}{}
+				if ctr.ExitCode != nil {
+					data["exitCode"] = *ctr.ExitCode
+				}
+				return enc.Encode(event{Type: "exit", ID: id, Data: data})
+			}
+			if cur != status {
+				switch cur {
+				case container.Paused:
+					enc.Encode(event{Type: "pause", ID: id})
+				case container.Running:
+					if status == container.Paused {
+						enc.Encode(event{Type: "resume", ID: id})
+					} else {
+						enc.Encode(event{Type: "start", ID: id})
+					}
+				}
+				status = cur
+			}
+
+			s, ooms, err := collectStats(ctr, status)
+			if err != nil {
+				logrus.Warnf("events %s: %v", id, err)
+			} else {
+				if !first && ooms > lastOOM {
+					enc.Encode(event{Type: "oom", ID: id})
+				}
+				lastOOM, first = ooms, false
+				if err := enc.Encode(event{Type: "stats", ID: id, Data: s}); err != nil {
+					return err
+				}
+			}
+			time.Sleep(interval)
+		}
+	},
+}
+
+// collectStats gathers stats from Firecracker, the VMM process and, when
+// the guest is running, the agent. It also returns the guest's OOM kill
+// count.
+func collectStats(ctr *container.Container, status container.Status) (*stats, uint64, error) {
+	m, err := vm.ReadMetrics(ctr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s := &stats{}
+	s.VM.VcpuExits = m.VcpuExits
+	s.Blkio.IoServiceBytesRecursive = []blkioEntry{
+		{Major: vm.VirtioBlkMajor, Op: "Read", Value: m.BlockReadBytes},
+		{Major: vm.VirtioBlkMajor, Op: "Write", Value: m.BlockWriteBytes},
+		{Major: vm.VirtioBlkMajor, Op: "Total", Value: m.BlockReadBytes + m.BlockWriteBytes},
+	}
+	s.Blkio.IoServicedRecursive = []blkioEntry{
+		{Major: vm.VirtioBlkMajor, Op: "Read", Value: m.BlockReadCount},
+		{Major: vm.VirtioBlkMajor, Op: "Write", Value: m.BlockWriteCount},
+		{Major: vm.VirtioBlkMajor, Op: "Total", Value: m.BlockReadCount + m.BlockWriteCount},
+	}
+	if ctr.TapDevice != "" {
+		s.NetworkInterfaces = []*networkInterface{{
+			Name:      "eth0",
+			RxBytes:   m.NetRxBytes,
+			RxPackets: m.NetRxPackets,
+			TxBytes:   m.NetTxBytes,
+			TxPackets: m.NetTxPackets,
+		}}
+	}
+
+	if user, system, rss, err := vm.ProcessUsage(ctr.PID); err == nil {
+		s.CPU.Usage.User = user
+		s.CPU.Usage.Kernel = system
+		s.CPU.Usage.Total = user + system
+		s.VM.VmmRSS = rss
+	} else {
+		logrus.Debugf("stats %s: VMM usage: %v", ctr.ID, err)
+	}
+
+	limitMiB := ctr.MemoryMiB
+	if bs, err := vm.BalloonStats(ctr); err == nil {
+		if bs.ActualMib != nil {
+			s.VM.BalloonMiB = *bs.ActualMib
+			limitMiB -= *bs.ActualMib
+		}
+		s.Memory.Usage.Usage = uint64(bs.TotalMemory - bs.FreeMemory)
+		s.Memory.Cache = uint64(bs.DiskCaches)
+		s.VM.MajorFaults = bs.MajorFaults
+		s.VM.MinorFaults = bs.MinorFaults
+	} else {
+		// No balloon driver in the guest: fall back to what the VMM holds
+		logrus.Debugf("stats %s: %v", ctr.ID, err)
+		s.Memory.Usage.Usage = s.VM.VmmRSS
+	}
+	if limitMiB > 0 {
+		s.Memory.Usage.Limit = uint64(limitMiB) << 20
+	}
+
+	var ooms uint64
+	// A paused guest can't answer, and one that hasn't started has nothing
+	// worth counting.
+	if status == container.Running {
+		conn, resp, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestStats})
+		if err == nil {
+			conn.Close()
+			if resp.Stats != nil {
+				s.Pids.Current = uint64(resp.Stats.Pids)
+				ooms = resp.Stats.OOMKills
+				s.Memory.Usage.Failcnt = ooms
+			}
+		} else {
+			logrus.Debugf("stats %s: guest stats: %v", ctr.ID, err)
+		}
+	}
+	return s, ooms, nil
+}
@@ -0,0 +1,212 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var ExecCommand = &cli.Command{
+	Name:  "exec",
+	Usage: "execute a new process inside the container",
+	ArgsUsage: `<container-id> <command> [command options]  || -p process.json <container-id>
+
+Where "<container-id>" is the name for the instance of the container and
+"<command>" is the command to be executed in the container.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "process",
+			Aliases: []string{"p"},
+			Usage:   "path to the process.json",
+		},
+		&cli.StringFlag{
+			Name:  "console-socket",
+			Usage: "path to AF_UNIX socket for terminal I/O",
+		},
+		&cli.StringFlag{
+			Name:  "pid-file",
+			Usage: "file to write the process ID to",
+		},
+		&cli.BoolFlag{
+			Name:    "detach",
+			Aliases: []string{"d"},
+			Usage:   "detach from the container's process",
+		},
+		&cli.BoolFlag{
+			Name:    "tty",
+			Aliases: []string{"t"},
+			Usage:   "allocate a pseudo-TTY",
+		},
+		&cli.StringFlag{
+			Name:  "cwd",
+			Usage: "current working directory in the container",
+		},
+		&cli.StringSliceFlag{
+			Name:    "env",
+			Aliases: []string{"e"},
+			Usage:   "set environment variables",
+		},
+		&cli.StringFlag{
+			Name:    "user",
+			Aliases: []string{"u"},
+			Usage:   "UID (format: <uid>[:<gid>])",
+		},
+		&cli.Int64SliceFlag{
+			Name:    "additional-gids",
+			Aliases: []string{"g"},
+			Usage:   "additional gids",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		rootDir := c.String("root")
+		consoleSocket := c.String("console-socket")
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		if status := ctr.EffectiveStatus(); status != container.Running {
+			return fmt.Errorf("container %q is not running (status: %s)", id, status)
+		}
+
+		proc, err := execProcess(c)
+		if err != nil {
+			return err
+		}
+		if proc.Terminal && consoleSocket == "" && c.Bool("detach") {
+			return fmt.Errorf("cannot allocate a tty for a detached process without --console-socket")
+		}
+
+		logrus.Debugf("exec: id=%s args=%v terminal=%v", id, proc.Args, proc.Terminal)
+
+		conn, resp, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestExec, Process: proc})
+		if err != nil {
+			return fmt.Errorf("exec in container %q: %w", id, err)
+		}
+		defer conn.Close()
+
+		logrus.Infof("exec started in container %s (guest PID %d)", id, resp.PID)
+
+		stdio := [3]*os.File{os.Stdin, os.Stdout, os.Stderr}
+		if proc.Terminal && consoleSocket != "" {
+			slave, err := vm.OpenConsole(consoleSocket)
+			if err != nil {
+				return err
+			}
+			defer slave.Close()
+			// The guest allocates its own pty; keep the host side transparent
+			// so input isn't echoed or translated twice.
+			if _, err := vm.MakeRaw(slave); err != nil {
+				return fmt.Errorf("set console raw: %w", err)
+			}
+			stdio = [3]*os.File{slave, slave, slave}
+		}
+
+		if c.Bool("detach") {
+			var args []string
+			if proc.Terminal {
+				args = append(args, "--terminal")
+			}
+			pid, err := startRelay(c, conn, stdio, nil, args...)
+			if err != nil {
+				return err
+			}
+			return writePidFile(c.String("pid-file"), pid)
+		}
+
+		if err := writePidFile(c.String("pid-file"), os.Getpid()); err != nil {
+			return err
+		}
+		status, err := relayProcess(conn, agent.NewStdin(stdio[0]), stdio, proc.Terminal)
+		if err != nil {
+			return err
+		}
+		if code := status.ExitCode(); code != 0 {
+			return cli.Exit("", code)
+		}
+		return nil
+	},
+}
+
+// execProcess builds the process to run from --process or the command line.
+func execProcess(c *cli.Context) (*agent.Process, error) {
+	if path := c.String("process"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read process.json: %w", err)
+		}
+		var p specs.Process
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("parse process.json: %w", err)
+		}
+		if len(p.Args) == 0 {
+			return nil, fmt.Errorf("process args cannot be empty")
+		}
+		return &agent.Process{
+			Args:     p.Args,
+			Env:      p.Env,
+			Cwd:      p.Cwd,
+			Terminal: p.Terminal,
+			User:     agent.UserFromSpec(p.User),
+		}, nil
+	}
+
+	args := c.Args().Tail()
+	if len(args) == 0 {
+		return nil, fmt.Errorf("either a command or --process is required")
+	}
+	user, err := execUser(c.String("user"), c.Int64Slice("additional-gids"))
+	if err != nil {
+		return nil, err
+	}
+	return &agent.Process{
+		Args:     args,
+		Env:      c.StringSlice("env"),
+		Cwd:      c.String("cwd"),
+		Terminal: c.Bool("tty"),
+		User:     user,
+	}, nil
+}
+
+// execUser parses --user, "uid[:gid]", and --additional-gids. Without them
+// the process runs as root.
+func execUser(spec string, gids []int64) (agent.User, error) {
+	var u agent.User
+	if spec != "" {
+		uid, gid, hasGID := strings.Cut(spec, ":")
+		n, err := strconv.ParseUint(uid, 10, 32)
+		if err != nil {
+			return u, fmt.Errorf("invalid --user %q: uid must be numeric", spec)
+		}
+		u.UID = uint32(n)
+		if hasGID {
+			n, err := strconv.ParseUint(gid, 10, 32)
+			if err != nil {
+				return u, fmt.Errorf("invalid --user %q: gid must be numeric", spec)
+			}
+			u.GID = uint32(n)
+		}
+	}
+	for _, g := range gids {
+		if g < 0 || g > math.MaxUint32 {
+			return u, fmt.Errorf("invalid additional gid %d", g)
+		}
+		u.AdditionalGids = append(u.AdditionalGids, uint32(g))
+	}
+	return u, nil
+}
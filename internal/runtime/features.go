@@ -0,0 +1,117 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-spec/specs-go/features"
+)
+
+// Keys in the features annotations that describe dock-fire itself rather
+// than an annotation it reads.
+const (
+	featureMountTypes    = "dock-fire.features/mount-types"
+	featureLinuxHonoured = "dock-fire.features/linux-honoured"
+	featureLinuxIgnored  = "dock-fire.features/linux-ignored"
+)
+
+// supportedAnnotations are the bundle annotations dock-fire reads, with the
+// format of their values.
+var supportedAnnotations = map[string]string{
+	"dock-fire/memory":          "VM memory in MiB, or with an M or G suffix (256, 512M, 1G)",
+	"dock-fire/memory-headroom": "MiB added to resources.memory.limit to size the VM, or with an M or G suffix (64M)",
+	"dock-fire/vcpus":           "number of vCPUs, a positive integer",
+	"dock-fire/disk-size":       "minimum root image size in bytes, or with an M or G suffix (2G)",
+	"dock-fire/volume.<name>":   "named volume mount, destination[:size][:ro] (/data:10G)",
+}
+
+// Which specs.Linux fields take effect. The VM boundary replaces namespaces,
+// cgroups and the LSMs, so most of them have nothing to apply to.
+var (
+	linuxHonoured = []string{
+		"resources.memory.limit (VM size at create, balloon on update)",
+		"resources.cpu.quota",
+		"resources.cpu.period",
+		"resources.blockIO.throttle* (update only)",
+		"cgroupsPath (cgroup v2, for the VMM)",
+	}
+	linuxIgnored = []string{
+		"namespaces",
+		"uidMappings",
+		"gidMappings",
+		"timeOffsets",
+		"devices",
+		"resources (other limits at create)",
+		"rootfsPropagation",
+		"seccomp",
+		"sysctl",
+		"maskedPaths",
+		"readonlyPaths",
+		"mountLabel",
+		"intelRdt",
+		"personality",
+	}
+	// Mount types and hooks honoured from the bundle config
+	mountTypes     = []string{"bind", "tmpfs", "proc", "sysfs", "devpts", "mqueue", "cgroup", "cgroup2"}
+	supportedHooks = []string{
+		"prestart",
+		"createRuntime",
+		"createContainer",
+		"startContainer",
+		"poststart",
+		"poststop",
+	}
+)
+
+var FeaturesCommand = &cli.Command{
+	Name:  "features",
+	Usage: "show the enabled features",
+	Action: func(c *cli.Context) error {
+		disabled, enabled := false, true
+		annotations := map[string]string{
+			featureMountTypes:    strings.Join(mountTypes, ","),
+			featureLinuxHonoured: strings.Join(linuxHonoured, ","),
+			featureLinuxIgnored:  strings.Join(linuxIgnored, ","),
+		}
+		for k, v := range supportedAnnotations {
+			annotations[k] = v
+		}
+
+		feat := features.Features{
+			OCIVersionMin: "1.0.0",
+			OCIVersionMax: specs.Version,
+			Hooks:         supportedHooks,
+			Annotations:   annotations,
+			Linux: &features.Linux{
+				Namespaces:   []string{},
+				Capabilities: []string{},
+				Cgroup: &features.Cgroup{
+					V1:          &disabled,
+					V2:          &enabled,
+					Systemd:     &enabled,
+					SystemdUser: &disabled,
+					Rdma:        &disabled,
+				},
+				Seccomp:  &features.Seccomp{Enabled: &disabled},
+				Apparmor: &features.Apparmor{Enabled: &disabled},
+				Selinux:  &features.Selinux{Enabled: &disabled},
+				IntelRdt: &features.IntelRdt{Enabled: &disabled},
+				MountExtensions: &features.MountExtensions{
+					IDMap: &features.IDMap{Enabled: &disabled},
+				},
+				NetDevices: &features.NetDevices{Enabled: &disabled},
+			},
+		}
+
+		data, err := json.MarshalIndent(feat, "", "    ")
+		if err != nil {
+			return fmt.Errorf("marshal features: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
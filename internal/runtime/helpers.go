@@ -1,6 +1,9 @@
 package runtime
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/rorym/dock-fire/internal/container"
 	"github.com/rorym/dock-fire/internal/network"
 	"github.com/rorym/dock-fire/internal/rootfs"
@@ -9,8 +12,8 @@ import (
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
-func createRootfsImage(rootDir, id, rootfsPath string, spec *specs.Spec) (string, error) {
-	return rootfs.CreateImage(rootDir, id, rootfsPath, spec)
+func createRootfsImage(rootDir, id, rootfsPath string, spec *specs.Spec, volumes []container.Volume) (string, error) {
+	return rootfs.CreateImage(rootDir, id, rootfsPath, spec, volumes)
 }
 
 func setupNetworking(ctr *container.Container) error {
@@ -24,3 +27,14 @@ func startVM(ctr *container.Container, spec *specs.Spec, consoleSocket string) e
 func stopVM(ctr *container.Container) error {
 	return vm.Stop(ctr)
 }
+
+// writePidFile records pid at path. An empty path is a no-op.
+func writePidFile(path string, pid int) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d", pid)), 0o644); err != nil {
+		return fmt.Errorf("write pid file: %w", err)
+	}
+	return nil
+}
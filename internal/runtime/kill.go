@@ -6,7 +6,9 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/rorym/dock-fire/internal/agent"
 	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -20,7 +22,7 @@ Where "<container-id>" is your name for the instance of the container.`,
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
 			Name:  "all",
-			Usage: "send signal to all processes (ignored, VM has single process tree)",
+			Usage: "send signal to all processes in the container",
 		},
 	},
 	Action: func(c *cli.Context) error {
@@ -41,9 +43,9 @@ Where "<container-id>" is your name for the instance of the container.`,
 			return err
 		}
 
-		// The VM runs from the create phase, so accept kill in both created and running states
+		// The VM runs from the create phase, so accept kill in any live state
 		status := ctr.EffectiveStatus()
-		if status != container.Running && status != container.Created {
+		if status != container.Running && status != container.Created && status != container.Paused {
 			return fmt.Errorf("container %q is not running (status: %s)", id, status)
 		}
 
@@ -52,34 +54,126 @@ Where "<container-id>" is your name for the instance of the container.`,
 			return fmt.Errorf("unknown signal: %s", sigStr)
 		}
 
-		if err := syscall.Kill(ctr.PID, sig); err != nil {
-			return fmt.Errorf("kill VMM process %d: %w", ctr.PID, err)
+		// Before start the workload is held in init and there is nothing in
+		// the guest to signal; SIGKILL tears the VM down instead.
+		if status == container.Created {
+			if sig != syscall.SIGKILL {
+				return fmt.Errorf("container %q has not been started", id)
+			}
+			return killVMM(ctr)
+		}
+		// A paused guest can't run the agent to receive the signal.
+		if status == container.Paused {
+			if sig != syscall.SIGKILL {
+				return fmt.Errorf("container %q is paused", id)
+			}
+			return killVMM(ctr)
 		}
 
-		logrus.Infof("sent signal %s to container %s (PID %d)", sigStr, id, ctr.PID)
+		conn, _, err := vm.AgentRequest(ctr, &agent.Request{
+			Type:   agent.RequestSignal,
+			Signal: int(sig),
+			All:    c.Bool("all"),
+		})
+		if err != nil {
+			// An unresponsive guest can still be killed from the outside
+			if sig == syscall.SIGKILL {
+				logrus.Warnf("container %s: signal via agent failed, killing VM: %v", id, err)
+				return killVMM(ctr)
+			}
+			return fmt.Errorf("signal container %q: %w", id, err)
+		}
+		conn.Close()
+
+		logrus.Infof("sent signal %s to container %s", sigStr, id)
 		return nil
 	},
 }
 
+// killVMM kills the Firecracker process. The monitor records the main
+// process as killed once the VM is gone.
+func killVMM(ctr *container.Container) error {
+	if err := syscall.Kill(ctr.PID, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("kill VMM process %d: %w", ctr.PID, err)
+	}
+	logrus.Infof("killed VM for container %s (PID %d)", ctr.ID, ctr.PID)
+	return nil
+}
+
+// Linux real-time signal range as seen by applications (glibc reserves the
+// first two for its own use).
+const (
+	sigRTMin = 34
+	sigRTMax = 64
+)
+
+var signals = map[string]syscall.Signal{
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"QUIT":   syscall.SIGQUIT,
+	"ILL":    syscall.SIGILL,
+	"TRAP":   syscall.SIGTRAP,
+	"ABRT":   syscall.SIGABRT,
+	"IOT":    syscall.SIGIOT,
+	"BUS":    syscall.SIGBUS,
+	"FPE":    syscall.SIGFPE,
+	"KILL":   syscall.SIGKILL,
+	"USR1":   syscall.SIGUSR1,
+	"SEGV":   syscall.SIGSEGV,
+	"USR2":   syscall.SIGUSR2,
+	"PIPE":   syscall.SIGPIPE,
+	"ALRM":   syscall.SIGALRM,
+	"TERM":   syscall.SIGTERM,
+	"STKFLT": syscall.SIGSTKFLT,
+	"CHLD":   syscall.SIGCHLD,
+	"CLD":    syscall.SIGCLD,
+	"CONT":   syscall.SIGCONT,
+	"STOP":   syscall.SIGSTOP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+	"VTALRM": syscall.SIGVTALRM,
+	"PROF":   syscall.SIGPROF,
+	"WINCH":  syscall.SIGWINCH,
+	"IO":     syscall.SIGIO,
+	"POLL":   syscall.SIGPOLL,
+	"PWR":    syscall.SIGPWR,
+	"SYS":    syscall.SIGSYS,
+}
+
+// parseSignal accepts a signal name with or without the SIG prefix,
+// RTMIN+n / RTMAX-n, or a number. It returns 0 for anything else.
 func parseSignal(s string) syscall.Signal {
 	s = strings.TrimPrefix(strings.ToUpper(s), "SIG")
 
-	signals := map[string]syscall.Signal{
-		"HUP":  syscall.SIGHUP,
-		"INT":  syscall.SIGINT,
-		"QUIT": syscall.SIGQUIT,
-		"KILL": syscall.SIGKILL,
-		"TERM": syscall.SIGTERM,
-		"USR1": syscall.SIGUSR1,
-		"USR2": syscall.SIGUSR2,
-	}
-
 	if sig, ok := signals[s]; ok {
 		return sig
 	}
 
+	if strings.HasPrefix(s, "RTMIN") || strings.HasPrefix(s, "RTMAX") {
+		base, rest := sigRTMin, s[len("RTMIN"):]
+		if strings.HasPrefix(s, "RTMAX") {
+			base = sigRTMax
+		}
+		n := base
+		if rest != "" {
+			off, err := strconv.Atoi(rest)
+			if err != nil {
+				return 0
+			}
+			n = base + off
+		}
+		if n < sigRTMin || n > sigRTMax {
+			return 0
+		}
+		return syscall.Signal(n)
+	}
+
 	// Try parsing as a number
-	if n, err := strconv.Atoi(s); err == nil {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= sigRTMax {
 		return syscall.Signal(n)
 	}
 
@@ -0,0 +1,106 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// containerSummary is one row of list output.
+type containerSummary struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid"`
+	Status    string    `json:"status"`
+	Bundle    string    `json:"bundle"`
+	Created   time.Time `json:"created"`
+	GuestIP   string    `json:"guestIP,omitempty"`
+	TapDevice string    `json:"tapDevice,omitempty"`
+}
+
+var ListCommand = &cli.Command{
+	Name:  "list",
+	Usage: "lists containers started by dock-fire with the given root",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   "table",
+			Usage:   "select one of: table or json",
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Usage:   "display only container IDs",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		format := c.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("invalid format option: %s", format)
+		}
+		rootDir := c.String("root")
+
+		ids, err := container.List(rootDir)
+		if err != nil {
+			return fmt.Errorf("list containers: %w", err)
+		}
+
+		summaries := []containerSummary{}
+		for _, id := range ids {
+			ctr, err := container.Load(rootDir, id)
+			if err != nil {
+				// A create in progress or a half-deleted state dir
+				logrus.Warnf("skipping %s: %v", id, err)
+				continue
+			}
+			status := ctr.EffectiveStatus()
+			pid := 0
+			if status != container.Stopped {
+				pid = ctr.ProcessPID()
+			}
+			summaries = append(summaries, containerSummary{
+				ID:        ctr.ID,
+				PID:       pid,
+				Status:    string(status),
+				Bundle:    ctr.Bundle,
+				Created:   ctr.Created,
+				GuestIP:   ctr.GuestIP,
+				TapDevice: ctr.TapDevice,
+			})
+		}
+
+		if c.Bool("quiet") {
+			for _, s := range summaries {
+				fmt.Println(s.ID)
+			}
+			return nil
+		}
+
+		if format == "json" {
+			data, err := json.Marshal(summaries)
+			if err != nil {
+				return fmt.Errorf("marshal list: %w", err)
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "ID\tPID\tSTATUS\tBUNDLE\tCREATED\tGUEST IP\tTAP\n")
+		for _, s := range summaries {
+			created := ""
+			if !s.Created.IsZero() {
+				created = s.Created.Format(time.RFC3339Nano)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+				s.ID, s.PID, s.Status, s.Bundle, created, s.GuestIP, s.TapDevice)
+		}
+		return w.Flush()
+	},
+}
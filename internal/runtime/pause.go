@@ -0,0 +1,86 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var PauseCommand = &cli.Command{
+	Name:  "pause",
+	Usage: "pause suspends all processes inside the container",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is your name for the instance of the container.`,
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		rootDir := c.String("root")
+
+		logrus.Debugf("pause: id=%s", id)
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		if status := ctr.EffectiveStatus(); status != container.Running {
+			return fmt.Errorf("container %q is not running (status: %s)", id, status)
+		}
+
+		if err := vm.Pause(ctr); err != nil {
+			return fmt.Errorf("pause container %q: %w", id, err)
+		}
+		if err := ctr.Transition(container.Paused); err != nil {
+			return fmt.Errorf("transition to paused: %w", err)
+		}
+		if err := ctr.Save(); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+
+		logrus.Infof("container %s paused", id)
+		return nil
+	},
+}
+
+var ResumeCommand = &cli.Command{
+	Name:  "resume",
+	Usage: "resumes all processes that have been previously paused",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is your name for the instance of the container.`,
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		rootDir := c.String("root")
+
+		logrus.Debugf("resume: id=%s", id)
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		if status := ctr.EffectiveStatus(); status != container.Paused {
+			return fmt.Errorf("container %q is not paused (status: %s)", id, status)
+		}
+
+		if err := vm.Resume(ctr); err != nil {
+			return fmt.Errorf("resume container %q: %w", id, err)
+		}
+		if err := ctr.Transition(container.Running); err != nil {
+			return fmt.Errorf("transition to running: %w", err)
+		}
+		if err := ctr.Save(); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+
+		logrus.Infof("container %s resumed", id)
+		return nil
+	},
+}
@@ -0,0 +1,79 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var PsCommand = &cli.Command{
+	Name:  "ps",
+	Usage: "ps displays the processes running inside a container",
+	ArgsUsage: `<container-id> [ps options]
+
+Where "<container-id>" is your name for the instance of the container.
+The table lists the processes inside the VM, with guest PIDs. The json
+format lists the host PIDs of the VMM and monitor instead, which is what
+callers that look the PIDs up on the host expect. ps options are not
+supported.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   "table",
+			Usage:   "select one of: table or json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		format := c.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("invalid format option: %s", format)
+		}
+		if extra := c.Args().Tail(); len(extra) > 0 {
+			logrus.Debugf("ps: ignoring ps options %v", extra)
+		}
+		rootDir := c.String("root")
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		status := ctr.EffectiveStatus()
+		if status != container.Running && status != container.Created {
+			return fmt.Errorf("container %q is not running (status: %s)", id, status)
+		}
+
+		if format == "json" {
+			data, err := json.Marshal(ctr.HostPIDs())
+			if err != nil {
+				return fmt.Errorf("marshal pids: %w", err)
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		conn, resp, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestPs})
+		if err != nil {
+			return fmt.Errorf("list processes in container %q: %w", id, err)
+		}
+		conn.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 5, 1, 3, ' ', 0)
+		fmt.Fprint(w, "UID\tPID\tPPID\tSTAT\tCMD\n")
+		for _, p := range resp.Processes {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\n", p.UID, p.PID, p.PPID, p.State, p.Command)
+		}
+		return w.Flush()
+	},
+}
@@ -0,0 +1,332 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+// relayConnFd is the descriptor the agent connection is passed on to a
+// detached relay process.
+const relayConnFd = 3
+
+// vmmExitTimeout is how long the monitor waits for the VM to shut down after
+// the main process exits before killing the VMM.
+const vmmExitTimeout = 10 * time.Second
+
+// RelayCommand is the background half of a detached exec, and the monitor
+// for a container's main process. It inherits the agent connection and the
+// caller's stdio, pumps I/O until the guest process exits, and then exits
+// with the same status so the shim can reap it.
+var RelayCommand = &cli.Command{
+	Name:   "relay",
+	Hidden: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "terminal",
+			Usage: "stdio is a terminal",
+		},
+		&cli.StringFlag{
+			Name:  "container",
+			Usage: "record the exit status as this container's main process",
+		},
+		&cli.BoolFlag{
+			Name:  "stdio",
+			Usage: "carry the container's main process's stdio",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		f := os.NewFile(relayConnFd, "agent")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("agent connection: %w", err)
+		}
+		defer conn.Close()
+
+		stdio := [3]*os.File{os.Stdin, os.Stdout, os.Stderr}
+		// One reader of stdin for every connection, so nothing read for a
+		// connection that drops is lost
+		stdin := agent.NewStdin(stdio[0])
+		terminal := c.Bool("terminal")
+		status, err := relayProcess(conn, stdin, stdio, terminal)
+		id := c.String("container")
+		for id != "" && err != nil {
+			// Taking a snapshot resets the guest's vsock connections. If
+			// the VM survived, ask again.
+			next, rerr := rewait(c.String("root"), id, c.Bool("stdio"))
+			if rerr != nil {
+				break
+			}
+			conn.Close()
+			conn = next
+			status, err = relayProcess(conn, stdin, stdio, terminal)
+		}
+		if id != "" {
+			if err != nil {
+				// The VM went away without reporting, most likely killed.
+				logrus.Warnf("container %s: no exit status from guest: %v", id, err)
+				status = agent.ExitStatus{Signal: int(syscall.SIGKILL)}
+			}
+			conn.Close()
+			finishContainer(c.String("root"), id, status)
+		} else if err != nil {
+			return err
+		}
+		if code := status.ExitCode(); code != 0 {
+			return cli.Exit("", code)
+		}
+		return nil
+	},
+}
+
+// startMonitor spawns the relay that waits on the container's main process.
+// Its PID is what containerd waits on, so it must outlive create. Unless the
+// process is on a terminal, which is the VM's serial console, the monitor
+// also takes over our stdio and carries the process's stdio over vsock.
+// It inherits locks and holds them until it exits.
+func startMonitor(c *cli.Context, ctr *container.Container, terminal bool, locks []*os.File) error {
+	conn, _, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestWait, Stdio: !terminal})
+	if err != nil {
+		return fmt.Errorf("wait on main process: %w", err)
+	}
+	defer conn.Close()
+
+	args := []string{"--container", ctr.ID}
+	stdio := [3]*os.File{os.Stdin, os.Stdout, os.Stderr}
+	if terminal {
+		devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer devNull.Close()
+		stdio = [3]*os.File{devNull, devNull, devNull}
+	} else {
+		args = append(args, "--stdio")
+	}
+
+	pid, err := startRelay(c, conn, stdio, locks, args...)
+	if err != nil {
+		return err
+	}
+	ctr.MonitorPID = pid
+	return nil
+}
+
+// rewait sends a fresh wait request for the container's main process,
+// retrying for as long as the VM is up. It fails once the VMM has gone.
+func rewait(rootDir, id string, stdio bool) (net.Conn, error) {
+	for {
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ctr.IsVMMAlive() {
+			return nil, fmt.Errorf("VM is not running")
+		}
+		// A paused VM can't answer, so DialAgent times out and we go round
+		// again until it is resumed or killed.
+		conn, _, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestWait, Stdio: stdio})
+		if err == nil {
+			logrus.Debugf("container %s: reconnected to guest agent", id)
+			return conn, nil
+		}
+		logrus.Debugf("container %s: wait on main process: %v", id, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// finishContainer records the main process's exit status and waits for the
+// VM to shut down, so the container reads as stopped once the monitor exits.
+func finishContainer(rootDir, id string, status agent.ExitStatus) {
+	ctr, err := container.Load(rootDir, id)
+	if err != nil {
+		logrus.Warnf("record exit status: %v", err)
+		return
+	}
+
+	deadline := time.Now().Add(vmmExitTimeout)
+	for ctr.IsVMMAlive() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if ctr.IsVMMAlive() {
+		logrus.Warnf("container %s: VM still running after main process exit, stopping it", id)
+		stopVM(ctr)
+	}
+	// The container may have been deleted while the VM went down; saving
+	// would bring its state back
+	if ctr, err = container.Load(rootDir, id); err != nil {
+		logrus.Debugf("container %s: not recording exit status: %v", id, err)
+		return
+	}
+	// The guest's writes to bind mounts only reach the host now
+	if err := rootfs.SyncVolumes(ctr.Volumes); err != nil {
+		logrus.Warnf("container %s: %v", id, err)
+	}
+
+	code := status.ExitCode()
+	ctr.ExitCode = &code
+	if status.Signal != 0 {
+		ctr.ExitSignal = unix.SignalName(syscall.Signal(status.Signal))
+	}
+	if !container.Exists(rootDir, id) {
+		return
+	}
+	if err := ctr.Save(); err != nil {
+		logrus.Warnf("record exit status: %v", err)
+	}
+	logrus.Infof("container %s main process exited with status %d", id, code)
+}
+
+// waitMonitor waits up to timeout for the container's monitor to exit,
+// which it does once it has synced volumes and recorded the exit status.
+// It reports whether the monitor is gone.
+func waitMonitor(ctr *container.Container, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for ctr.MonitorPID > 0 && processRunning(ctr.MonitorPID) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// processRunning reports whether pid exists and hasn't exited. A zombie
+// waiting to be reaped has exited.
+func processRunning(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which may contain spaces
+	end := bytes.LastIndexByte(data, ')')
+	return end >= 0 && end+2 < len(data) && data[end+2] != 'Z'
+}
+
+// waitContainer blocks until the container's monitor has exited and returns
+// the main process's exit code.
+func waitContainer(rootDir, id string) (int, error) {
+	for {
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return 0, err
+		}
+		if ctr.MonitorPID <= 0 || syscall.Kill(ctr.MonitorPID, 0) != nil {
+			if ctr.ExitCode == nil {
+				return 0, fmt.Errorf("container %q exited without a status", id)
+			}
+			return *ctr.ExitCode, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// startRelay spawns a detached relay process that takes over conn and stdio,
+// returning its PID. extra files are passed on after conn and only kept
+// open. args are passed to the relay command.
+func startRelay(c *cli.Context, conn net.Conn, stdio [3]*os.File, extra []*os.File, args ...string) (int, error) {
+	fc, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("agent connection cannot be passed to a child process")
+	}
+	connFile, err := fc.File()
+	if err != nil {
+		return 0, fmt.Errorf("agent connection fd: %w", err)
+	}
+	defer connFile.Close()
+
+	cmd, err := selfCommand(c, append([]string{"relay"}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	cmd.Stdin = stdio[0]
+	cmd.Stdout = stdio[1]
+	cmd.Stderr = stdio[2]
+	cmd.ExtraFiles = append([]*os.File{connFile}, extra...)
+	// Run in its own session so it survives the caller. With a terminal the
+	// pty becomes its controlling tty and resizes arrive as SIGWINCH.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: slices.Contains(args, "--terminal") && vm.IsTerminal(stdio[0]),
+		Ctty:    0,
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start relay: %w", err)
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	logrus.Debugf("started relay process %d", pid)
+	return pid, nil
+}
+
+// selfCommand returns a command that re-executes this binary with the
+// current global flags followed by args.
+func selfCommand(c *cli.Context, args ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find executable: %w", err)
+	}
+	global := []string{"--root", c.String("root")}
+	if v := c.String("log"); v != "" {
+		global = append(global, "--log", v)
+	}
+	if v := c.String("log-format"); v != "" {
+		global = append(global, "--log-format", v)
+	}
+	if c.Bool("debug") {
+		global = append(global, "--debug")
+	}
+	return exec.Command(exe, append(global, args...)...), nil
+}
+
+// relayProcess pumps stdio between the caller and a guest process until it
+// exits, with stdin read from stdio[0] through stdin. When terminal is set
+// and stdio[0] is a tty, window size changes are forwarded to the guest.
+func relayProcess(conn net.Conn, stdin *agent.Stdin, stdio [3]*os.File, terminal bool) (agent.ExitStatus, error) {
+	var resize chan agent.WindowSize
+	if terminal && vm.IsTerminal(stdio[0]) {
+		// A tty we didn't set up ourselves (an interactive exec from a
+		// shell) needs raw mode so keystrokes reach the guest unchanged.
+		if state, err := vm.MakeRaw(stdio[0]); err == nil {
+			defer vm.RestoreTerminal(stdio[0], state)
+		}
+
+		resize = make(chan agent.WindowSize, 1)
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		winch <- syscall.SIGWINCH
+		go func() {
+			for range winch {
+				rows, cols, err := vm.TerminalSize(stdio[0])
+				if err != nil {
+					continue
+				}
+				resize <- agent.WindowSize{Rows: rows, Cols: cols}
+			}
+		}()
+	}
+
+	var stderr io.Writer
+	if !terminal {
+		stderr = stdio[2]
+	}
+	return agent.Relay(conn, stdin, stdio[1], stderr, resize)
+}
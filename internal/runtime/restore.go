@@ -0,0 +1,177 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/cgroup"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/network"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var RestoreCommand = &cli.Command{
+	Name:  "restore",
+	Usage: "restore a container from a previous checkpoint",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container to be
+restored.`,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "image-path",
+			Usage: "path to the checkpoint to restore from",
+		},
+		&cli.StringFlag{
+			Name:  "bundle",
+			Value: ".",
+			Usage: "path to the root of the OCI bundle",
+		},
+		&cli.StringFlag{
+			Name:  "console-socket",
+			Usage: "path to AF_UNIX socket for terminal I/O",
+		},
+		&cli.StringFlag{
+			Name:  "pid-file",
+			Usage: "file to write the process ID to",
+		},
+		&cli.BoolFlag{
+			Name:    "detach",
+			Aliases: []string{"d"},
+			Usage:   "detach from the container's process",
+		},
+		// no-pivot and no-subreaper are expected by containerd but we don't use them
+		&cli.BoolFlag{Name: "no-pivot", Hidden: true},
+		&cli.BoolFlag{Name: "no-subreaper", Hidden: true},
+	}, criuFlags()...),
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		imageDir := c.String("image-path")
+		if imageDir == "" {
+			return fmt.Errorf("--image-path is required")
+		}
+		imageDir, err := filepath.Abs(imageDir)
+		if err != nil {
+			return err
+		}
+		bundle, err := filepath.Abs(c.String("bundle"))
+		if err != nil {
+			return err
+		}
+		rootDir := c.String("root")
+
+		logrus.Debugf("restore: id=%s image-path=%s bundle=%s", id, imageDir, bundle)
+
+		if container.Exists(rootDir, id) {
+			return fmt.Errorf("container %q already exists", id)
+		}
+
+		data, err := os.ReadFile(filepath.Join(imageDir, checkpointMetaFile))
+		if err != nil {
+			return fmt.Errorf("read checkpoint metadata: %w", err)
+		}
+		var meta checkpointMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("parse checkpoint metadata: %w", err)
+		}
+
+		spec, err := oci.LoadConfig(bundle)
+		if err != nil {
+			return fmt.Errorf("load OCI config: %w", err)
+		}
+
+		ctr := &container.Container{
+			ID:        id,
+			Bundle:    bundle,
+			Status:    container.Creating,
+			RootDir:   rootDir,
+			Created:   time.Now().UTC(),
+			ImagePath: filepath.Join(rootDir, id, checkpointRootfs),
+
+			SystemdCgroup: c.Bool("systemd-cgroup"),
+		}
+		if err := os.MkdirAll(filepath.Dir(ctr.ImagePath), 0o700); err != nil {
+			return fmt.Errorf("mkdir state dir: %w", err)
+		}
+		if err := rootfs.CopySparse(filepath.Join(imageDir, checkpointRootfs), ctr.ImagePath); err != nil {
+			container.Delete(rootDir, id)
+			return fmt.Errorf("copy rootfs image: %w", err)
+		}
+
+		// The guest's address is part of the snapshot, so keep its subnet
+		// when it is free and readdress the guest otherwise.
+		if meta.SubnetCIDR != "" {
+			if err := network.SetupPreferring(ctr, meta.SubnetCIDR); err != nil {
+				container.Delete(rootDir, id)
+				return fmt.Errorf("setup networking: %w", err)
+			}
+		}
+
+		memPath := filepath.Join(imageDir, checkpointMemFile)
+		statePath := filepath.Join(imageDir, checkpointStateFile)
+		from := vm.SnapshotPaths{ImagePath: meta.ImagePath, VsockPath: meta.VsockPath, TapDevice: meta.TapDevice}
+		if err := vm.Restore(ctr, spec, c.String("console-socket"), memPath, statePath, from); err != nil {
+			cgroup.Remove(ctr)
+			network.Teardown(ctr)
+			container.Delete(rootDir, id)
+			return fmt.Errorf("restore VM: %w", err)
+		}
+		if ctr.SubnetCIDR != meta.SubnetCIDR {
+			if err := vm.SetGuestAddress(ctr); err != nil {
+				stopVM(ctr)
+				cgroup.Remove(ctr)
+				network.Teardown(ctr)
+				container.Delete(rootDir, id)
+				return err
+			}
+		}
+
+		if err := startMonitor(c, ctr, spec.Process != nil && spec.Process.Terminal, nil); err != nil {
+			stopVM(ctr)
+			cgroup.Remove(ctr)
+			network.Teardown(ctr)
+			container.Delete(rootDir, id)
+			return fmt.Errorf("start monitor: %w", err)
+		}
+		if err := cgroup.AddProcess(ctr, ctr.MonitorPID); err != nil {
+			logrus.Warnf("container %s: %v", id, err)
+		}
+
+		// Dirty page tracking restarts from the restored memory, which makes
+		// this checkpoint the parent for the next diff.
+		ctr.LastCheckpoint = imageDir
+		if err := ctr.Transition(container.Running); err != nil {
+			return fmt.Errorf("transition to running: %w", err)
+		}
+		if err := ctr.Save(); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+		if err := writePidFile(c.String("pid-file"), ctr.ProcessPID()); err != nil {
+			return err
+		}
+
+		logrus.Infof("container %s restored from %s (VMM PID: %d, monitor PID: %d)", id, imageDir, ctr.PID, ctr.MonitorPID)
+
+		if c.Bool("detach") {
+			return nil
+		}
+		code, err := waitContainer(rootDir, id)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return cli.Exit("", code)
+		}
+		return nil
+	},
+}
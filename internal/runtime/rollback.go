@@ -0,0 +1,99 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/rorym/dock-fire/internal/cgroup"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/network"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/sirupsen/logrus"
+)
+
+// rollbackCreate releases everything recorded in a create's undo journal,
+// most recent first, ending with the state directory. It does nothing if
+// there is no journal, i.e. create finished.
+func rollbackCreate(rootDir, id string) error {
+	entries, err := container.NewJournal(rootDir, id).Entries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	logrus.Debugf("container %s: rolling back %d create steps", id, len(entries))
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		switch e.Kind {
+		case container.UndoVM:
+			pid := e.PID
+			if pid == 0 && len(e.Sockets) > 0 {
+				// Create may have died before the PID was recorded
+				pid = findVMM(e.Sockets[0])
+			}
+			if pid > 0 && len(e.Sockets) > 0 && isVMM(pid, e.Sockets[0]) {
+				if err := stopVM(&container.Container{ID: id, PID: pid}); err != nil {
+					logrus.Warnf("container %s: stop VMM: %v", id, err)
+				}
+			}
+			for _, s := range e.Sockets {
+				os.Remove(s)
+			}
+		case container.UndoCgroup:
+			if err := cgroup.Remove(&container.Container{ID: id, CgroupPath: e.Path, CgroupUnit: e.Unit}); err != nil {
+				logrus.Warnf("container %s: %v", id, err)
+			}
+		case container.UndoNetwork:
+			network.Teardown(&container.Container{ID: id, TapDevice: e.TAP, SubnetCIDR: e.Subnet})
+		case container.UndoImage:
+			if err := rootfs.RemoveImage(e.Path); err != nil {
+				logrus.Warnf("container %s: %v", id, err)
+			}
+		case container.UndoStateDir:
+			if err := os.RemoveAll(e.Path); err != nil {
+				return fmt.Errorf("remove state dir: %w", err)
+			}
+		default:
+			logrus.Warnf("container %s: unknown undo entry %q", id, e.Kind)
+		}
+	}
+	return nil
+}
+
+// findVMM returns the PID of the Firecracker process serving apiSocket, or
+// 0 if there is none.
+func findVMM(apiSocket string) int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if isVMM(pid, apiSocket) {
+			return pid
+		}
+	}
+	return 0
+}
+
+// isVMM reports whether pid is still the Firecracker process serving
+// apiSocket. A journal can outlive the process, and its PID be reused.
+func isVMM(pid int, apiSocket string) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	for _, arg := range bytes.Split(cmdline, []byte{0}) {
+		if string(arg) == apiSocket {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var RunCommand = &cli.Command{
+	Name:  "run",
+	Usage: "create and run a container",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is your name for the instance of the container.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "bundle",
+			Value: ".",
+			Usage: "path to the root of the OCI bundle",
+		},
+		&cli.StringFlag{
+			Name:  "console-socket",
+			Usage: "path to AF_UNIX socket for terminal I/O",
+		},
+		&cli.StringFlag{
+			Name:  "pid-file",
+			Usage: "file to write the process ID to",
+		},
+		&cli.BoolFlag{
+			Name:    "detach",
+			Aliases: []string{"d"},
+			Usage:   "detach from the container's process",
+		},
+		&cli.BoolFlag{
+			Name:  "rm",
+			Usage: "delete the container after it exits",
+		},
+		// no-pivot and no-subreaper are expected by containerd but we don't use them
+		&cli.BoolFlag{Name: "no-pivot", Hidden: true},
+		&cli.BoolFlag{Name: "no-subreaper", Hidden: true},
+	},
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		detach := c.Bool("detach")
+		if detach && c.Bool("rm") {
+			return fmt.Errorf("--rm cannot be used with --detach")
+		}
+		rootDir := c.String("root")
+
+		logrus.Debugf("run: id=%s", id)
+
+		ctr, err := createContainer(c, id)
+		if err != nil {
+			return err
+		}
+		spec, err := oci.LoadConfig(ctr.Bundle)
+		if err != nil {
+			deleteContainer(ctr, true)
+			return fmt.Errorf("load OCI config: %w", err)
+		}
+
+		// Without a console socket the VM's serial console is our own
+		// stdio. A terminal workload needs raw mode so keystrokes, ^C
+		// included, reach the guest tty unchanged.
+		if !detach && c.String("console-socket") == "" && spec.Process.Terminal && vm.IsTerminal(os.Stdin) {
+			if state, err := vm.MakeRaw(os.Stdin); err == nil {
+				defer vm.RestoreTerminal(os.Stdin, state)
+			}
+		}
+
+		if err := startContainer(ctr); err != nil {
+			deleteContainer(ctr, true)
+			return err
+		}
+		if err := writePidFile(c.String("pid-file"), ctr.ProcessPID()); err != nil {
+			deleteContainer(ctr, true)
+			return err
+		}
+
+		logrus.Infof("container %s running (VMM PID: %d, monitor PID: %d)", id, ctr.PID, ctr.MonitorPID)
+
+		if detach {
+			return nil
+		}
+
+		stop := forwardSignals(ctr)
+		code, err := waitContainer(rootDir, id)
+		stop()
+		if err != nil {
+			if c.Bool("rm") {
+				deleteContainer(ctr, true)
+			}
+			return err
+		}
+
+		if c.Bool("rm") {
+			ctr, err := container.Load(rootDir, id)
+			if err != nil {
+				return err
+			}
+			if err := deleteContainer(ctr, true); err != nil {
+				return err
+			}
+			logrus.Infof("container %s deleted", id)
+		}
+
+		if code != 0 {
+			return cli.Exit("", code)
+		}
+		return nil
+	},
+}
+
+// forwardSignals relays signals sent to the runtime to the container's main
+// process until the returned function is called.
+func forwardSignals(ctr *container.Container) func() {
+	sigc := make(chan os.Signal, 16)
+	signal.Notify(sigc)
+	go func() {
+		for s := range sigc {
+			sig := s.(syscall.Signal)
+			switch sig {
+			case syscall.SIGCHLD, syscall.SIGWINCH, syscall.SIGURG, syscall.SIGPIPE:
+				continue
+			}
+			conn, _, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestSignal, Signal: int(sig)})
+			if err != nil {
+				logrus.Warnf("container %s: forward signal %s: %v", ctr.ID, sig, err)
+				continue
+			}
+			conn.Close()
+			logrus.Debugf("container %s: forwarded signal %s", ctr.ID, sig)
+		}
+	}()
+	return func() {
+		signal.Stop(sigc)
+		close(sigc)
+	}
+}
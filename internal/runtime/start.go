@@ -2,10 +2,15 @@ package runtime
 
 import (
 	"fmt"
+	"syscall"
 
+	"github.com/rorym/dock-fire/internal/agent"
 	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
 )
 
 var StartCommand = &cli.Command{
@@ -28,20 +33,74 @@ Where "<container-id>" is your name for the instance of the container.`,
 			return err
 		}
 
-		if ctr.Status != container.Created {
-			return fmt.Errorf("container %q is not in created state (status: %s)", id, ctr.Status)
-		}
-
-		// The VM was already booted during create.
-		// Just transition the state to running.
-		if err := ctr.Transition(container.Running); err != nil {
-			return fmt.Errorf("transition to running: %w", err)
-		}
-		if err := ctr.Save(); err != nil {
-			return fmt.Errorf("save state: %w", err)
+		if err := startContainer(ctr); err != nil {
+			return err
 		}
 
 		logrus.Infof("container %s started (VMM PID: %d)", id, ctr.PID)
 		return nil
 	},
 }
+
+// startContainer runs the startContainer hooks and tells dock-fire-init to
+// release the container's main process.
+func startContainer(ctr *container.Container) error {
+	if status := ctr.EffectiveStatus(); status != container.Created {
+		return fmt.Errorf("container %q is not in created state (status: %s)", ctr.ID, status)
+	}
+
+	spec, err := oci.LoadConfig(ctr.Bundle)
+	if err != nil {
+		return fmt.Errorf("load OCI config: %w", err)
+	}
+	if err := vm.RunStartHooks(ctr, spec.Hooks); err != nil {
+		abortStart(ctr)
+		return err
+	}
+
+	// The VM was booted during create and dock-fire-init is holding the
+	// workload. Record the transition first: a short-lived process can
+	// exit, and have its status saved by the monitor, before we return.
+	if err := ctr.Transition(container.Running); err != nil {
+		return fmt.Errorf("transition to running: %w", err)
+	}
+	if err := ctr.Save(); err != nil {
+		return fmt.Errorf("save state: %w", err)
+	}
+
+	conn, _, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestStart})
+	if err != nil {
+		ctr.Status = container.Created
+		if saveErr := ctr.Save(); saveErr != nil {
+			logrus.Warnf("failed to restore created state: %v", saveErr)
+		}
+		return fmt.Errorf("start main process: %w", err)
+	}
+	conn.Close()
+
+	if spec.Hooks != nil {
+		vm.RunPostHooks(ctr, "poststart", spec.Hooks.Poststart)
+	}
+	return nil
+}
+
+// abortStart stops the VM of a container whose startContainer hooks
+// failed, as the runtime spec requires. The monitor records the exit once
+// the VM is gone; the container is then stopped, and delete runs its
+// poststop hooks.
+func abortStart(ctr *container.Container) {
+	if err := stopVM(ctr); err != nil {
+		logrus.Warnf("container %s: stop VM: %v", ctr.ID, err)
+	}
+	waitMonitor(ctr, vmmExitTimeout)
+	if latest, err := container.Load(ctr.RootDir, ctr.ID); err == nil && latest.ExitCode != nil {
+		return
+	}
+	// No monitor recorded it
+	code := 128 + int(syscall.SIGKILL)
+	ctr.ExitCode = &code
+	ctr.ExitSignal = unix.SignalName(syscall.SIGKILL)
+	if err := ctr.Save(); err != nil {
+		logrus.Warnf("record exit status: %v", err)
+	}
+}
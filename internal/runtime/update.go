@@ -0,0 +1,404 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// minGuestMemMiB is the least memory update will leave a guest with.
+const minGuestMemMiB = 32
+
+var UpdateCommand = &cli.Command{
+	Name:  "update",
+	Usage: "update container resource constraints",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is your name for the instance of the container.
+Only limits Firecracker can change on a running VM are supported: memory
+(through the balloon device), and disk and network bandwidth (through rate
+limiters). Anything else is rejected unless it matches the bundle.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "resources",
+			Aliases: []string{"r"},
+			Usage:   `path to the file containing the resources to update or '-' to read from the standard input`,
+		},
+		&cli.StringFlag{Name: "memory", Usage: "memory limit (in bytes)"},
+		&cli.StringFlag{Name: "memory-reservation", Usage: "memory reservation or soft_limit (in bytes)"},
+		&cli.StringFlag{Name: "memory-swap", Usage: "total memory usage (memory + swap); set '-1' to enable unlimited swap"},
+		&cli.StringFlag{Name: "cpu-period", Usage: "CPU CFS period to be used for hardcapping (in usecs). 0 to use system default"},
+		&cli.StringFlag{Name: "cpu-quota", Usage: "CPU CFS hardcap limit (in usecs). Allowed cpu time in a given period"},
+		&cli.StringFlag{Name: "cpu-share", Usage: "CPU shares (relative weight vs. other containers)"},
+		&cli.StringFlag{Name: "cpuset-cpus", Usage: "CPU(s) to use"},
+		&cli.StringFlag{Name: "cpuset-mems", Usage: "memory node(s) to use"},
+		&cli.Int64Flag{Name: "pids-limit", Usage: "maximum number of pids allowed in the container"},
+		&cli.UintFlag{Name: "blkio-weight", Usage: "specifies per cgroup weight, range is from 10 to 1000"},
+		&cli.StringFlag{Name: "disk-bps", Usage: "root drive bandwidth limit in bytes per second, reads and writes combined (0 for none)"},
+		&cli.Int64Flag{Name: "disk-iops", Usage: "root drive operations per second, reads and writes combined (0 for none)"},
+		&cli.StringFlag{Name: "net-rx-bps", Usage: "network receive limit in bytes per second (0 for none)"},
+		&cli.StringFlag{Name: "net-tx-bps", Usage: "network transmit limit in bytes per second (0 for none)"},
+	},
+	Action: func(c *cli.Context) error {
+		id := c.Args().First()
+		if id == "" {
+			return fmt.Errorf("container ID is required")
+		}
+		rootDir := c.String("root")
+
+		ctr, err := container.Load(rootDir, id)
+		if err != nil {
+			return err
+		}
+		if status := ctr.EffectiveStatus(); status != container.Running && status != container.Created {
+			return fmt.Errorf("container %q is not running (status: %s)", id, status)
+		}
+
+		r, err := updateResources(c)
+		if err != nil {
+			return err
+		}
+		rates, err := parseRateFlags(c)
+		if err != nil {
+			return err
+		}
+
+		// Limits the VM can't change must stay as they were at create
+		var base *specs.LinuxResources
+		if spec, err := oci.LoadConfig(ctr.Bundle); err == nil && spec.Linux != nil {
+			base = spec.Linux.Resources
+		} else if err != nil {
+			logrus.Warnf("update %s: load bundle config: %v", id, err)
+		}
+		if err := checkFixedResources(r, base); err != nil {
+			return fmt.Errorf("update container %q: %w", id, err)
+		}
+
+		limits := ctr.Limits
+		err = applyLimits(ctr, r, rates, &limits)
+		// Record whatever was applied, even if a later step failed
+		ctr.Limits = limits
+		if saveErr := ctr.Save(); saveErr != nil {
+			logrus.Warnf("save state: %v", saveErr)
+		}
+		if err != nil {
+			return fmt.Errorf("update container %q: %w", id, err)
+		}
+
+		logrus.Infof("container %s limits updated: %+v", id, limits)
+		return nil
+	},
+}
+
+// updateResources reads the requested resources from --resources and
+// overlays any individual flags.
+func updateResources(c *cli.Context) (*specs.LinuxResources, error) {
+	r := &specs.LinuxResources{}
+	if path := c.String("resources"); path != "" {
+		var in io.Reader = os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			in = f
+		}
+		if err := json.NewDecoder(in).Decode(r); err != nil {
+			return nil, fmt.Errorf("decode resources: %w", err)
+		}
+	}
+
+	for _, name := range []string{"memory", "memory-reservation", "memory-swap"} {
+		if !c.IsSet(name) {
+			continue
+		}
+		v, err := rootfs.ParseSize(c.String(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		if r.Memory == nil {
+			r.Memory = &specs.LinuxMemory{}
+		}
+		switch name {
+		case "memory":
+			r.Memory.Limit = &v
+		case "memory-reservation":
+			r.Memory.Reservation = &v
+		case "memory-swap":
+			r.Memory.Swap = &v
+		}
+	}
+
+	for _, name := range []string{"cpu-period", "cpu-quota", "cpu-share", "cpuset-cpus", "cpuset-mems"} {
+		if !c.IsSet(name) {
+			continue
+		}
+		if r.CPU == nil {
+			r.CPU = &specs.LinuxCPU{}
+		}
+		v := c.String(name)
+		var err error
+		switch name {
+		case "cpu-period":
+			var n uint64
+			_, err = fmt.Sscan(v, &n)
+			r.CPU.Period = &n
+		case "cpu-quota":
+			var n int64
+			_, err = fmt.Sscan(v, &n)
+			r.CPU.Quota = &n
+		case "cpu-share":
+			var n uint64
+			_, err = fmt.Sscan(v, &n)
+			r.CPU.Shares = &n
+		case "cpuset-cpus":
+			r.CPU.Cpus = v
+		case "cpuset-mems":
+			r.CPU.Mems = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+
+	if c.IsSet("pids-limit") {
+		n := c.Int64("pids-limit")
+		r.Pids = &specs.LinuxPids{Limit: &n}
+	}
+	if c.IsSet("blkio-weight") {
+		w := uint16(c.Uint("blkio-weight"))
+		if r.BlockIO == nil {
+			r.BlockIO = &specs.LinuxBlockIO{}
+		}
+		r.BlockIO.Weight = &w
+	}
+	return r, nil
+}
+
+// checkFixedResources rejects changes to limits that are fixed once the VM
+// has booted. Zero, unset and unlimited values are treated alike, since
+// containerd sends every field whether or not it changed.
+func checkFixedResources(r, base *specs.LinuxResources) error {
+	if base == nil {
+		base = &specs.LinuxResources{}
+	}
+	var fixed []string
+
+	if r.CPU != nil {
+		cur := base.CPU
+		if cur == nil {
+			cur = &specs.LinuxCPU{}
+		}
+		if u64(r.CPU.Shares) != u64(cur.Shares) {
+			fixed = append(fixed, "cpu shares")
+		}
+		if limit(r.CPU.Quota) != limit(cur.Quota) || u64(r.CPU.Period) != u64(cur.Period) {
+			fixed = append(fixed, "cpu quota")
+		}
+		if limit(r.CPU.RealtimeRuntime) != limit(cur.RealtimeRuntime) || u64(r.CPU.RealtimePeriod) != u64(cur.RealtimePeriod) {
+			fixed = append(fixed, "cpu realtime")
+		}
+		if r.CPU.Cpus != cur.Cpus || r.CPU.Mems != cur.Mems {
+			fixed = append(fixed, "cpuset")
+		}
+	}
+	if r.Pids != nil {
+		var cur *int64
+		if base.Pids != nil {
+			cur = base.Pids.Limit
+		}
+		if limit(r.Pids.Limit) != limit(cur) {
+			fixed = append(fixed, "pids limit")
+		}
+	}
+	if r.Memory != nil {
+		cur := base.Memory
+		if cur == nil {
+			cur = &specs.LinuxMemory{}
+		}
+		if limit(r.Memory.Reservation) != limit(cur.Reservation) {
+			fixed = append(fixed, "memory reservation")
+		}
+	}
+	if r.BlockIO != nil {
+		var cur uint16
+		if base.BlockIO != nil && base.BlockIO.Weight != nil {
+			cur = *base.BlockIO.Weight
+		}
+		if r.BlockIO.Weight != nil && *r.BlockIO.Weight != 0 && *r.BlockIO.Weight != cur {
+			fixed = append(fixed, "blkio weight")
+		}
+	}
+	if len(r.HugepageLimits) > 0 {
+		fixed = append(fixed, "hugepage limits")
+	}
+
+	if len(fixed) > 0 {
+		return fmt.Errorf("cannot change %s on a running VM", strings.Join(fixed, ", "))
+	}
+	return nil
+}
+
+// rateFlags are the rate limits given as flags, nil where a flag isn't set.
+type rateFlags struct {
+	diskBps, diskIOPS  *int64
+	netRxBps, netTxBps *int64
+}
+
+// parseRateFlags reads the rate limit flags. They are checked before any
+// limit is applied, so a bad one doesn't leave an update half done.
+func parseRateFlags(c *cli.Context) (*rateFlags, error) {
+	rates := &rateFlags{}
+	for _, f := range []struct {
+		name string
+		dst  **int64
+	}{
+		{"disk-bps", &rates.diskBps},
+		{"net-rx-bps", &rates.netRxBps},
+		{"net-tx-bps", &rates.netTxBps},
+	} {
+		if !c.IsSet(f.name) {
+			continue
+		}
+		n, err := rootfs.ParseSize(c.String(f.name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", f.name, err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q is negative", f.name, c.String(f.name))
+		}
+		*f.dst = &n
+	}
+	if c.IsSet("disk-iops") {
+		n := c.Int64("disk-iops")
+		if n < 0 {
+			return nil, fmt.Errorf("invalid value for disk-iops: %d is negative", n)
+		}
+		rates.diskIOPS = &n
+	}
+	return rates, nil
+}
+
+// applyLimits applies the live-changeable parts of r and rates, updating
+// limits as each one takes effect.
+func applyLimits(ctr *container.Container, r *specs.LinuxResources, rates *rateFlags, limits *container.Limits) error {
+	if r.Memory != nil && r.Memory.Limit != nil {
+		if r.Memory.Swap != nil {
+			logrus.Debugf("update %s: ignoring swap limit, guests have no swap", ctr.ID)
+		}
+		if err := applyMemoryLimit(ctr, *r.Memory.Limit, limits); err != nil {
+			return err
+		}
+	}
+
+	bps, iops := limits.DiskBps, limits.DiskIOPS
+	if bio := r.BlockIO; bio != nil {
+		if n, ok := throttleRate(bio.ThrottleReadBpsDevice, bio.ThrottleWriteBpsDevice); ok {
+			bps = n
+		}
+		if n, ok := throttleRate(bio.ThrottleReadIOPSDevice, bio.ThrottleWriteIOPSDevice); ok {
+			iops = n
+		}
+	}
+	if rates.diskBps != nil {
+		bps = *rates.diskBps
+	}
+	if rates.diskIOPS != nil {
+		iops = *rates.diskIOPS
+	}
+	if bps != limits.DiskBps || iops != limits.DiskIOPS {
+		if err := vm.SetDiskRateLimit(ctr, bps, iops); err != nil {
+			return err
+		}
+		limits.DiskBps, limits.DiskIOPS = bps, iops
+	}
+
+	rx, tx := limits.NetRxBps, limits.NetTxBps
+	if rates.netRxBps != nil {
+		rx = *rates.netRxBps
+	}
+	if rates.netTxBps != nil {
+		tx = *rates.netTxBps
+	}
+	if rx != limits.NetRxBps || tx != limits.NetTxBps {
+		if err := vm.SetNetRateLimit(ctr, rx, tx); err != nil {
+			return err
+		}
+		limits.NetRxBps, limits.NetTxBps = rx, tx
+	}
+	return nil
+}
+
+// applyMemoryLimit inflates the balloon so the guest is left with at most
+// limit bytes, plus the headroom of a VM sized from its spec's limit. A
+// limit at or above the VM size, or unlimited, empties it.
+func applyMemoryLimit(ctr *container.Container, limitBytes int64, limits *container.Limits) error {
+	if ctr.MemoryMiB <= 0 {
+		return fmt.Errorf("VM memory size is unknown; recreate the container to change its memory limit")
+	}
+	// A VM sized from the spec's limit keeps its headroom on top of a
+	// new one.
+	guestMiB := ctr.MemoryMiB
+	if limitBytes > 0 {
+		if n := limitBytes>>20 + ctr.MemoryHeadroomMiB; n < guestMiB {
+			guestMiB = n
+		}
+	}
+	if guestMiB < minGuestMemMiB {
+		return fmt.Errorf("memory limit of %d MiB is below the %d MiB minimum for a guest", guestMiB, minGuestMemMiB)
+	}
+
+	if err := vm.SetBalloon(ctr, ctr.MemoryMiB-guestMiB); err != nil {
+		return err
+	}
+	limits.MemoryMiB = 0
+	if guestMiB < ctr.MemoryMiB {
+		limits.MemoryMiB = guestMiB
+	}
+	return nil
+}
+
+// throttleRate folds per-device read and write throttles into the single
+// rate a Firecracker drive limiter takes: the tightest one given. There is
+// only one drive, so the device numbers are not consulted.
+func throttleRate(lists ...[]specs.LinuxThrottleDevice) (int64, bool) {
+	var rate uint64
+	found := false
+	for _, list := range lists {
+		for _, d := range list {
+			if !found || d.Rate < rate {
+				rate = d.Rate
+			}
+			found = true
+		}
+	}
+	return int64(rate), found
+}
+
+func u64(p *uint64) uint64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// limit normalises an optional signed limit, where zero and negative values
+// both mean unlimited.
+func limit(p *int64) int64 {
+	if p == nil || *p < 0 {
+		return 0
+	}
+	return *p
+}
@@ -0,0 +1,110 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/containerd/containerd/namespaces"
+	cdshim "github.com/containerd/containerd/runtime/v2/shim"
+)
+
+// StartShim is run by containerd as `containerd-shim-dockfire-v1 start`. It
+// spawns the long-lived shim for the task on a fresh socket and returns the
+// socket's address.
+func (s *service) StartShim(ctx context.Context, opts cdshim.StartOpts) (_ string, retErr error) {
+	cmd, err := shimCommand(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+
+	address, err := cdshim.SocketAddress(ctx, opts.Address, opts.ID)
+	if err != nil {
+		return "", err
+	}
+	socket, err := cdshim.NewSocket(address)
+	if err != nil {
+		// A socket left by a shim that is still serving the task is reused
+		if !cdshim.SocketEaddrinuse(err) {
+			return "", fmt.Errorf("create shim socket: %w", err)
+		}
+		if cdshim.CanConnect(address) {
+			if err := cdshim.WriteAddress("address", address); err != nil {
+				return "", fmt.Errorf("write existing socket for shim: %w", err)
+			}
+			return address, nil
+		}
+		if err := cdshim.RemoveSocket(address); err != nil {
+			return "", fmt.Errorf("remove stale socket: %w", err)
+		}
+		if socket, err = cdshim.NewSocket(address); err != nil {
+			return "", fmt.Errorf("create shim socket: %w", err)
+		}
+	}
+	defer func() {
+		if retErr != nil {
+			socket.Close()
+			cdshim.RemoveSocket(address)
+		}
+	}()
+
+	if err := cdshim.WriteAddress("address", address); err != nil {
+		return "", err
+	}
+
+	f, err := socket.File()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("start shim: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			cmd.Process.Kill()
+		}
+	}()
+	go cmd.Wait()
+
+	if err := cdshim.AdjustOOMScore(cmd.Process.Pid); err != nil {
+		return "", fmt.Errorf("adjust shim OOM score: %w", err)
+	}
+	return address, nil
+}
+
+// shimCommand returns the command that re-executes this binary as the
+// serving shim for opts.ID.
+func shimCommand(ctx context.Context, opts cdshim.StartOpts) (*exec.Cmd, error) {
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-namespace", ns,
+		"-id", opts.ID,
+		"-address", opts.Address,
+	}
+	if opts.Debug {
+		args = append(args, "-debug")
+	}
+	cmd := exec.Command(self, args...)
+	// containerd starts the shim in the bundle directory
+	cmd.Dir = cwd
+	cmd.Env = append(os.Environ(), "GOMAXPROCS=4")
+	// Its own process group, so signals for containerd don't reach it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, nil
+}
@@ -0,0 +1,250 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/fifo"
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/vm"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// process is the container's main process or one exec'd into it.
+type process struct {
+	id       string // exec ID, empty for the main process
+	terminal bool
+	stdin    string // fifo paths from containerd
+	stdout   string
+	stderr   string
+	spec     *specs.Process // exec only
+
+	mu         sync.Mutex
+	pid        int // guest PID for execs, VMM PID for the main process
+	started    bool
+	console    *os.File // pty master behind a terminal main process
+	stdinFifo  io.Closer
+	resize     chan agent.WindowSize
+	exited     chan struct{}
+	exitStatus int
+	exitedAt   time.Time
+
+	// stdio of a non-terminal main process, relayed by waitMain
+	in      io.Reader
+	out     io.Writer
+	errOut  io.Writer
+	outputs []io.Closer
+}
+
+func newProcess(id string, terminal bool, stdin, stdout, stderr string) *process {
+	return &process{
+		id:       id,
+		terminal: terminal,
+		stdin:    stdin,
+		stdout:   stdout,
+		stderr:   stderr,
+		exited:   make(chan struct{}),
+	}
+}
+
+// hasExited reports whether the process's exit status has been recorded.
+func (p *process) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// setExited records the exit status and wakes up waiters.
+func (p *process) setExited(status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hasExited() {
+		return
+	}
+	p.exitStatus = status
+	p.exitedAt = time.Now()
+	close(p.exited)
+}
+
+// closeStdin closes the stdin fifo so nothing more is forwarded to the guest.
+func (p *process) closeStdin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stdinFifo != nil {
+		p.stdinFifo.Close()
+		p.stdinFifo = nil
+	}
+}
+
+// resizeTerminal applies a window size to the process's terminal.
+func (p *process) resizeTerminal(rows, cols uint16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.console != nil {
+		return vm.SetTerminalSize(p.console, rows, cols)
+	}
+	if p.resize == nil {
+		return fmt.Errorf("process has no terminal")
+	}
+	// Only the latest size matters
+	select {
+	case <-p.resize:
+	default:
+	}
+	p.resize <- agent.WindowSize{Rows: rows, Cols: cols}
+	return nil
+}
+
+// openFifos opens the process's stdio fifos. Missing paths give nil.
+func (p *process) openFifos() (stdin io.ReadCloser, stdout, stderr io.WriteCloser, err error) {
+	// A background context: cancelling a pending open closes the fifo,
+	// and containerd may connect to stdin after the request returns.
+	ctx := context.Background()
+	closeAll := func() {
+		for _, c := range []io.Closer{stdin, stdout, stderr} {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	if p.stdin != "" {
+		if stdin, err = fifo.OpenFifo(ctx, p.stdin, syscall.O_RDONLY|syscall.O_NONBLOCK, 0); err != nil {
+			return nil, nil, nil, fmt.Errorf("open stdin: %w", err)
+		}
+	}
+	if p.stdout != "" {
+		if stdout, err = fifo.OpenFifo(ctx, p.stdout, syscall.O_WRONLY, 0); err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("open stdout: %w", err)
+		}
+	}
+	if p.stderr != "" && !p.terminal {
+		if stderr, err = fifo.OpenFifo(ctx, p.stderr, syscall.O_WRONLY, 0); err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("open stderr: %w", err)
+		}
+	}
+	return stdin, stdout, stderr, nil
+}
+
+// terminalIO wires a terminal main process's fifos to a pty whose slave the
+// VMM uses as the serial console, which the workload runs on. The VMM only
+// gets a real file, since exec.Cmd would wait on copies from a fifo that
+// doesn't close when the VM exits. release closes our copy of the slave
+// once the VMM has started.
+func (p *process) terminalIO() (slave *os.File, release func(), err error) {
+	stdin, stdout, _, err := p.openFifos()
+	if err != nil {
+		return nil, nil, err
+	}
+	master, slave, err := vm.OpenPTY()
+	if err != nil {
+		for _, c := range []io.Closer{stdin, stdout} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		return nil, nil, fmt.Errorf("open pty: %w", err)
+	}
+	if stdin != nil {
+		go io.Copy(master, stdin)
+	}
+	if stdout != nil {
+		go func() {
+			io.Copy(stdout, master)
+			stdout.Close()
+		}()
+	}
+	p.mu.Lock()
+	p.console = master
+	p.stdinFifo = stdin
+	p.mu.Unlock()
+	return slave, func() { slave.Close() }, nil
+}
+
+// openStdio opens a non-terminal main process's fifos, which waitMain
+// relays over its agent connection.
+func (p *process) openStdio() error {
+	stdin, stdout, stderr, err := p.openFifos()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stdin != nil {
+		p.stdinFifo = stdin
+		p.in = stdin
+	}
+	p.out = io.Discard
+	if stdout != nil {
+		p.out = stdout
+		p.outputs = append(p.outputs, stdout)
+	}
+	if stderr != nil {
+		p.errOut = stderr
+		p.outputs = append(p.outputs, stderr)
+	}
+	return nil
+}
+
+// closeOutputs closes the stdout and stderr fifos opened by openStdio, so
+// containerd sees the end of the output.
+func (p *process) closeOutputs() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.outputs {
+		c.Close()
+	}
+	p.outputs = nil
+}
+
+// relay pumps an exec'd process's stdio over its agent connection until it
+// exits, returning the exit status.
+func (p *process) relay(conn net.Conn) int {
+	defer conn.Close()
+
+	stdin, stdout, stderr, err := p.openFifos()
+	if err != nil {
+		return 128 + int(syscall.SIGKILL)
+	}
+	defer func() {
+		for _, c := range []io.Closer{stdout, stderr} {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+
+	var in io.Reader
+	if stdin != nil {
+		in = stdin
+		p.mu.Lock()
+		p.stdinFifo = stdin
+		p.mu.Unlock()
+		defer p.closeStdin()
+	}
+	var out, errOut io.Writer = io.Discard, nil
+	if stdout != nil {
+		out = stdout
+	}
+	if stderr != nil {
+		errOut = stderr
+	}
+
+	status, err := agent.Relay(conn, agent.NewStdin(in), out, errOut, p.resize)
+	if err != nil {
+		// The VM went away underneath the process
+		return 128 + int(syscall.SIGKILL)
+	}
+	return status.ExitCode()
+}
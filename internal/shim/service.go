@@ -0,0 +1,700 @@
+// Package shim implements the containerd shim v2 task service on top of
+// dock-fire's VM, network and rootfs packages. One shim process owns one
+// task: it boots the VM, keeps the Firecracker machine handle for the life
+// of the task and collects exit statuses from the guest agent itself,
+// rather than forking the dock-fire runtime for every operation.
+package shim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/protobuf"
+	ptypes "github.com/containerd/containerd/protobuf/types"
+	"github.com/containerd/containerd/runtime"
+	cdshim "github.com/containerd/containerd/runtime/v2/shim"
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/cgroup"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/network"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/rorym/dock-fire/internal/rootfs"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// RuntimeName is the containerd runtime type served by this shim.
+const RuntimeName = "io.containerd.dockfire.v1"
+
+// stateRoot holds container state for tasks run by the shim, one directory
+// per containerd namespace. It sits under the runtime's default root so
+// `dock-fire --root /run/dock-fire/<namespace>` can inspect them.
+const stateRoot = "/run/dock-fire"
+
+// vmmExitTimeout is how long to wait for the VM to power off after the main
+// process exits before stopping the VMM.
+const vmmExitTimeout = 10 * time.Second
+
+type service struct {
+	ctx       context.Context
+	id        string
+	publisher cdshim.Publisher
+	shutdown  func()
+
+	mu      sync.Mutex
+	ctr     *container.Container
+	hooks   *specs.Hooks
+	machine *firecracker.Machine
+	vmDone  chan struct{}
+	main    *process
+	execs   map[string]*process
+	// sourceLocks keep writable bind mount sources locked until the
+	// guest's changes are synced back.
+	sourceLocks []*os.File
+}
+
+// New returns the task service for the shim serving task id.
+func New(ctx context.Context, id string, publisher cdshim.Publisher, shutdown func()) (cdshim.Shim, error) {
+	return &service{
+		ctx:       ctx,
+		id:        id,
+		publisher: publisher,
+		shutdown:  shutdown,
+		execs:     make(map[string]*process),
+	}, nil
+}
+
+// rootDir returns the container state root for ctx's namespace.
+func rootDir(ctx context.Context) (string, error) {
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateRoot, ns), nil
+}
+
+// publish sends a task event to containerd. Failures are only logged: the
+// task itself has already changed state.
+func (s *service) publish(topic string, event interface{}) {
+	if err := s.publisher.Publish(s.ctx, topic, event); err != nil {
+		logrus.Warnf("publish %s: %v", topic, err)
+	}
+}
+
+// process returns the main process for an empty execID, or the exec.
+func (s *service) process(execID string) (*process, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.main == nil {
+		return nil, fmt.Errorf("task %s: %w", s.id, errdefs.ErrNotFound)
+	}
+	if execID == "" {
+		return s.main, nil
+	}
+	p, ok := s.execs[execID]
+	if !ok {
+		return nil, fmt.Errorf("exec %s: %w", execID, errdefs.ErrNotFound)
+	}
+	return p, nil
+}
+
+func (s *service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (_ *taskAPI.CreateTaskResponse, retErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctr != nil {
+		return nil, fmt.Errorf("task %s: %w", r.ID, errdefs.ErrAlreadyExists)
+	}
+	if r.Checkpoint != "" {
+		return nil, fmt.Errorf("create from checkpoint: %w", errdefs.ErrNotImplemented)
+	}
+	root, err := rootDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if container.Exists(root, r.ID) {
+		return nil, fmt.Errorf("container %q: %w", r.ID, errdefs.ErrAlreadyExists)
+	}
+
+	spec, err := oci.LoadConfig(r.Bundle)
+	if err != nil {
+		return nil, fmt.Errorf("load OCI config: %w", err)
+	}
+
+	ctr := &container.Container{
+		ID:      r.ID,
+		Bundle:  r.Bundle,
+		Status:  container.Creating,
+		RootDir: root,
+		Created: time.Now().UTC(),
+	}
+	defer func() {
+		if retErr != nil {
+			vm.Stop(ctr)
+			cgroup.Remove(ctr)
+			network.Teardown(ctr)
+			container.Delete(root, r.ID)
+		}
+	}()
+
+	ctr.Volumes = rootfs.BindVolumes(root, r.ID, spec)
+	sourceLocks, err := rootfs.LockSources(ctr.Volumes)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			rootfs.UnlockSources(sourceLocks)
+		}
+	}()
+	for _, v := range ctr.Volumes {
+		if err := rootfs.BuildVolumeImage(v); err != nil {
+			return nil, fmt.Errorf("create volume %s: %w", v.Destination, err)
+		}
+	}
+	named, err := rootfs.NamedVolumes(spec)
+	if err != nil {
+		return nil, err
+	}
+	ctr.Volumes = append(ctr.Volumes, named...)
+	imagePath, err := buildImage(root, r, spec, ctr.Volumes)
+	if err != nil {
+		return nil, err
+	}
+	ctr.ImagePath = imagePath
+
+	if err := network.Setup(ctr); err != nil {
+		return nil, fmt.Errorf("setup networking: %w", err)
+	}
+
+	// A terminal workload runs on the VM's serial console. Otherwise its
+	// stdio goes over vsock and the console is only logged.
+	main := newProcess("", r.Terminal, r.Stdin, r.Stdout, r.Stderr)
+	defer func() {
+		if retErr != nil {
+			main.closeOutputs()
+		}
+	}()
+	var (
+		console *os.File
+		release func()
+	)
+	if r.Terminal {
+		console, release, err = main.terminalIO()
+	} else {
+		if err = main.openStdio(); err == nil {
+			console, err = vm.OpenConsoleLog(ctr)
+			release = func() { console.Close() }
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var consoleIn io.Reader
+	if r.Terminal {
+		consoleIn = console
+	}
+	machine, err := vm.StartWithIO(ctr, spec, consoleIn, console)
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("start VM: %w", err)
+	}
+	main.pid = ctr.PID
+
+	// Ask for the exit status now: the guest holds the workload until
+	// start, and a wait is what tells it someone is listening.
+	conn, _, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestWait, Stdio: !r.Terminal})
+	if err != nil {
+		return nil, fmt.Errorf("wait on main process: %w", err)
+	}
+	if err := vm.RunCreateHooks(ctr, spec.Hooks); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := ctr.Transition(container.Created); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("transition to created: %w", err)
+	}
+	if err := ctr.Save(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("save state: %w", err)
+	}
+
+	s.ctr = ctr
+	s.hooks = spec.Hooks
+	s.machine = machine
+	s.main = main
+	s.sourceLocks = sourceLocks
+	s.vmDone = make(chan struct{})
+	go func() {
+		machine.Wait(context.Background())
+		close(s.vmDone)
+	}()
+	go s.waitMain(conn)
+
+	s.publish(runtime.TaskCreateEventTopic, &eventstypes.TaskCreate{
+		ContainerID: r.ID,
+		Bundle:      r.Bundle,
+		Rootfs:      r.Rootfs,
+		IO: &eventstypes.TaskIO{
+			Stdin:    r.Stdin,
+			Stdout:   r.Stdout,
+			Stderr:   r.Stderr,
+			Terminal: r.Terminal,
+		},
+		Pid: uint32(ctr.PID),
+	})
+
+	logrus.Infof("task %s created (VMM PID: %d)", r.ID, ctr.PID)
+	return &taskAPI.CreateTaskResponse{Pid: uint32(ctr.PID)}, nil
+}
+
+// buildImage mounts the snapshot containerd prepared for the task and
+// copies it into the VM's root drive. The image is a copy, so the snapshot
+// is unmounted again straight away.
+func buildImage(root string, r *taskAPI.CreateTaskRequest, spec *specs.Spec, volumes []container.Volume) (string, error) {
+	rootfsPath := filepath.Join(r.Bundle, "rootfs")
+	if spec.Root != nil && spec.Root.Path != "" {
+		rootfsPath = spec.Root.Path
+		if !filepath.IsAbs(rootfsPath) {
+			rootfsPath = filepath.Join(r.Bundle, rootfsPath)
+		}
+	}
+
+	if len(r.Rootfs) > 0 {
+		mounts := make([]mount.Mount, 0, len(r.Rootfs))
+		for _, m := range r.Rootfs {
+			mounts = append(mounts, mount.Mount{
+				Type:    m.Type,
+				Source:  m.Source,
+				Target:  m.Target,
+				Options: m.Options,
+			})
+		}
+		if err := os.MkdirAll(rootfsPath, 0o711); err != nil {
+			return "", fmt.Errorf("mkdir rootfs: %w", err)
+		}
+		if err := mount.All(mounts, rootfsPath); err != nil {
+			return "", fmt.Errorf("mount rootfs: %w", err)
+		}
+		defer func() {
+			if err := mount.UnmountAll(rootfsPath, 0); err != nil {
+				logrus.Warnf("unmount rootfs: %v", err)
+			}
+		}()
+	}
+
+	imagePath, err := rootfs.CreateImage(root, r.ID, rootfsPath, spec, volumes)
+	if err != nil {
+		return "", fmt.Errorf("create rootfs image: %w", err)
+	}
+	return imagePath, nil
+}
+
+// waitMain collects the main process's exit status from the guest and
+// reports it once the VM has shut down. Taking a snapshot resets the
+// guest's vsock connections, so it asks again while the VM is up.
+func (s *service) waitMain(conn net.Conn) {
+	p := s.main
+	// One reader of the stdin fifo for every connection, so nothing read
+	// for a connection that drops is lost
+	var stdin *agent.Stdin
+	if !p.terminal {
+		stdin = agent.NewStdin(p.in)
+	}
+	relay := func(conn net.Conn) (agent.ExitStatus, error) {
+		defer conn.Close()
+		if p.terminal {
+			return agent.Relay(conn, nil, io.Discard, nil, nil)
+		}
+		return agent.Relay(conn, stdin, p.out, p.errOut, nil)
+	}
+
+	status, err := relay(conn)
+	for err != nil {
+		select {
+		case <-s.vmDone:
+		case <-time.After(100 * time.Millisecond):
+			conn, _, err = vm.AgentRequest(s.ctr, &agent.Request{Type: agent.RequestWait, Stdio: !p.terminal})
+			if err == nil {
+				status, err = relay(conn)
+			}
+			continue
+		}
+		// The VM went away without reporting, most likely killed.
+		logrus.Warnf("task %s: no exit status from guest: %v", s.id, err)
+		status = agent.ExitStatus{Signal: int(syscall.SIGKILL)}
+		break
+	}
+
+	select {
+	case <-s.vmDone:
+	case <-time.After(vmmExitTimeout):
+		logrus.Warnf("task %s: VM still running after main process exit, stopping it", s.id)
+		s.machine.StopVMM()
+		<-s.vmDone
+	}
+	if err := rootfs.SyncVolumes(s.ctr.Volumes); err != nil {
+		logrus.Warnf("task %s: %v", s.id, err)
+	}
+	rootfs.UnlockSources(s.sourceLocks)
+
+	code := status.ExitCode()
+	s.mu.Lock()
+	s.ctr.ExitCode = &code
+	if status.Signal != 0 {
+		s.ctr.ExitSignal = unix.SignalName(syscall.Signal(status.Signal))
+	}
+	if err := s.ctr.Save(); err != nil {
+		logrus.Warnf("record exit status: %v", err)
+	}
+	s.mu.Unlock()
+
+	p.closeOutputs()
+	p.setExited(code)
+	s.publish(runtime.TaskExitEventTopic, &eventstypes.TaskExit{
+		ContainerID: s.id,
+		ID:          s.id,
+		Pid:         uint32(s.main.pid),
+		ExitStatus:  uint32(code),
+		ExitedAt:    protobuf.ToTimestamp(s.main.exitedAt),
+	})
+	logrus.Infof("task %s main process exited with status %d", s.id, code)
+}
+
+func (s *service) Start(ctx context.Context, r *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if r.ExecID != "" {
+		return s.startExec(p)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctr.EffectiveStatus() != container.Created {
+		return nil, fmt.Errorf("task %s is not in created state: %w", s.id, errdefs.ErrFailedPrecondition)
+	}
+	if err := vm.RunStartHooks(s.ctr, s.hooks); err != nil {
+		// The runtime spec has the container stopped when a
+		// startContainer hook fails; waitMain records the exit
+		s.machine.StopVMM()
+		return nil, err
+	}
+	// Record the transition first: a short-lived process can exit before
+	// the start request returns.
+	if err := s.ctr.Transition(container.Running); err != nil {
+		return nil, err
+	}
+	if err := s.ctr.Save(); err != nil {
+		return nil, fmt.Errorf("save state: %w", err)
+	}
+	conn, _, err := vm.AgentRequest(s.ctr, &agent.Request{Type: agent.RequestStart})
+	if err != nil {
+		s.ctr.Status = container.Created
+		s.ctr.Save()
+		return nil, fmt.Errorf("start main process: %w", err)
+	}
+	conn.Close()
+
+	p.mu.Lock()
+	p.started = true
+	p.mu.Unlock()
+
+	if s.hooks != nil {
+		vm.RunPostHooks(s.ctr, "poststart", s.hooks.Poststart)
+	}
+	s.publish(runtime.TaskStartEventTopic, &eventstypes.TaskStart{
+		ContainerID: s.id,
+		Pid:         uint32(p.pid),
+	})
+	return &taskAPI.StartResponse{Pid: uint32(p.pid)}, nil
+}
+
+func (s *service) startExec(p *process) (*taskAPI.StartResponse, error) {
+	p.mu.Lock()
+	started := p.started
+	p.mu.Unlock()
+	if started {
+		return nil, fmt.Errorf("exec %s already started: %w", p.id, errdefs.ErrFailedPrecondition)
+	}
+	if status := s.status(); status != container.Running {
+		return nil, fmt.Errorf("task %s is %s: %w", s.id, status, errdefs.ErrFailedPrecondition)
+	}
+
+	conn, resp, err := vm.AgentRequest(s.ctr, &agent.Request{
+		Type: agent.RequestExec,
+		Process: &agent.Process{
+			Args:     p.spec.Args,
+			Env:      p.spec.Env,
+			Cwd:      p.spec.Cwd,
+			Terminal: p.terminal,
+			User:     agent.UserFromSpec(p.spec.User),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("exec in guest: %w", err)
+	}
+
+	p.mu.Lock()
+	p.pid = resp.PID
+	p.started = true
+	p.mu.Unlock()
+
+	go func() {
+		code := p.relay(conn)
+		p.setExited(code)
+		s.publish(runtime.TaskExitEventTopic, &eventstypes.TaskExit{
+			ContainerID: s.id,
+			ID:          p.id,
+			Pid:         uint32(p.pid),
+			ExitStatus:  uint32(code),
+			ExitedAt:    protobuf.ToTimestamp(p.exitedAt),
+		})
+	}()
+
+	s.publish(runtime.TaskExecStartedEventTopic, &eventstypes.TaskExecStarted{
+		ContainerID: s.id,
+		ExecID:      p.id,
+		Pid:         uint32(p.pid),
+	})
+	return &taskAPI.StartResponse{Pid: uint32(p.pid)}, nil
+}
+
+// status returns the container's current status.
+func (s *service) status() container.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctr.EffectiveStatus()
+}
+
+func (s *service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ExecID != "" {
+		p.mu.Lock()
+		running := p.started && !p.hasExited()
+		p.mu.Unlock()
+		if running {
+			return nil, fmt.Errorf("exec %s is running: %w", r.ExecID, errdefs.ErrFailedPrecondition)
+		}
+		s.mu.Lock()
+		delete(s.execs, r.ExecID)
+		s.mu.Unlock()
+		return &taskAPI.DeleteResponse{
+			Pid:        uint32(p.pid),
+			ExitStatus: uint32(p.exitStatus),
+			ExitedAt:   protobuf.ToTimestamp(p.exitedAt),
+		}, nil
+	}
+
+	// A task that was created but never started still has a VM holding
+	// the workload.
+	if !p.hasExited() {
+		p.mu.Lock()
+		started := p.started
+		p.mu.Unlock()
+		if started {
+			return nil, fmt.Errorf("task %s is running: %w", s.id, errdefs.ErrFailedPrecondition)
+		}
+		s.machine.StopVMM()
+		<-p.exited
+	}
+
+	s.mu.Lock()
+	ctr := s.ctr
+	s.mu.Unlock()
+	if err := cgroup.Remove(ctr); err != nil {
+		logrus.Warnf("failed to remove cgroup: %v", err)
+	}
+	if err := network.Teardown(ctr); err != nil {
+		logrus.Warnf("failed to tear down networking: %v", err)
+	}
+	if ctr.SocketPath != "" {
+		os.Remove(ctr.SocketPath)
+	}
+	if ctr.VsockPath != "" {
+		os.Remove(ctr.VsockPath)
+	}
+	if s.hooks != nil {
+		vm.RunPostHooks(ctr, "poststop", s.hooks.Poststop)
+	}
+	if err := container.Delete(ctr.RootDir, ctr.ID); err != nil {
+		return nil, fmt.Errorf("delete state: %w", err)
+	}
+
+	s.publish(runtime.TaskDeleteEventTopic, &eventstypes.TaskDelete{
+		ContainerID: s.id,
+		Pid:         uint32(p.pid),
+		ExitStatus:  uint32(p.exitStatus),
+		ExitedAt:    protobuf.ToTimestamp(p.exitedAt),
+	})
+	return &taskAPI.DeleteResponse{
+		Pid:        uint32(p.pid),
+		ExitStatus: uint32(p.exitStatus),
+		ExitedAt:   protobuf.ToTimestamp(p.exitedAt),
+	}, nil
+}
+
+func (s *service) Exec(ctx context.Context, r *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	if _, err := s.process(""); err != nil {
+		return nil, err
+	}
+	var spec specs.Process
+	if err := json.Unmarshal(r.Spec.GetValue(), &spec); err != nil {
+		return nil, fmt.Errorf("parse process spec: %w", err)
+	}
+	if len(spec.Args) == 0 {
+		return nil, fmt.Errorf("exec %s has no args: %w", r.ExecID, errdefs.ErrInvalidArgument)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.execs[r.ExecID]; ok {
+		return nil, fmt.Errorf("exec %s: %w", r.ExecID, errdefs.ErrAlreadyExists)
+	}
+	p := newProcess(r.ExecID, r.Terminal, r.Stdin, r.Stdout, r.Stderr)
+	p.spec = &spec
+	if r.Terminal {
+		p.resize = make(chan agent.WindowSize, 1)
+	}
+	s.execs[r.ExecID] = p
+
+	s.publish(runtime.TaskExecAddedEventTopic, &eventstypes.TaskExecAdded{
+		ContainerID: s.id,
+		ExecID:      r.ExecID,
+	})
+	return &ptypes.Empty{}, nil
+}
+
+func (s *service) State(ctx context.Context, r *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	status := s.status()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	resp := &taskAPI.StateResponse{
+		ID:       s.id,
+		ExecID:   r.ExecID,
+		Bundle:   s.ctr.Bundle,
+		Pid:      uint32(p.pid),
+		Stdin:    p.stdin,
+		Stdout:   p.stdout,
+		Stderr:   p.stderr,
+		Terminal: p.terminal,
+	}
+	switch {
+	case p.hasExited():
+		resp.Status = task.Status_STOPPED
+		resp.ExitStatus = uint32(p.exitStatus)
+		resp.ExitedAt = protobuf.ToTimestamp(p.exitedAt)
+	case !p.started:
+		resp.Status = task.Status_CREATED
+	case status == container.Paused:
+		resp.Status = task.Status_PAUSED
+	default:
+		resp.Status = task.Status_RUNNING
+	}
+	return resp, nil
+}
+
+func (s *service) Wait(ctx context.Context, r *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-p.exited:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &taskAPI.WaitResponse{
+		ExitStatus: uint32(p.exitStatus),
+		ExitedAt:   protobuf.ToTimestamp(p.exitedAt),
+	}, nil
+}
+
+func (s *service) Connect(ctx context.Context, r *taskAPI.ConnectRequest) (*taskAPI.ConnectResponse, error) {
+	var pid int
+	s.mu.Lock()
+	if s.ctr != nil {
+		pid = s.ctr.PID
+	}
+	s.mu.Unlock()
+	return &taskAPI.ConnectResponse{
+		ShimPid: uint32(os.Getpid()),
+		TaskPid: uint32(pid),
+	}, nil
+}
+
+func (s *service) Shutdown(ctx context.Context, r *taskAPI.ShutdownRequest) (*ptypes.Empty, error) {
+	s.mu.Lock()
+	ctr := s.ctr
+	s.mu.Unlock()
+	// Stay up while the task's state is still around to be deleted
+	if ctr != nil && container.Exists(ctr.RootDir, ctr.ID) && !r.Now {
+		return &ptypes.Empty{}, nil
+	}
+	s.shutdown()
+	return &ptypes.Empty{}, nil
+}
+
+// Cleanup is run by containerd in a fresh shim process when the original
+// went away without deleting its task. It tears down whatever the task left
+// on the host.
+func (s *service) Cleanup(ctx context.Context) (*taskAPI.DeleteResponse, error) {
+	root, err := rootDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ctr, err := container.Load(root, s.id); err == nil {
+		if ctr.IsVMMAlive() {
+			syscall.Kill(ctr.PID, syscall.SIGKILL)
+		}
+		if err := cgroup.Remove(ctr); err != nil {
+			logrus.Warnf("failed to remove cgroup: %v", err)
+		}
+		if err := network.Teardown(ctr); err != nil {
+			logrus.Warnf("failed to tear down networking: %v", err)
+		}
+		if ctr.SocketPath != "" {
+			os.Remove(ctr.SocketPath)
+		}
+		if ctr.VsockPath != "" {
+			os.Remove(ctr.VsockPath)
+		}
+	}
+	if err := container.Delete(root, s.id); err != nil {
+		logrus.Warnf("delete state: %v", err)
+	}
+	return &taskAPI.DeleteResponse{
+		ExitStatus: 128 + uint32(syscall.SIGKILL),
+		ExitedAt:   protobuf.ToTimestamp(time.Now()),
+	}, nil
+}
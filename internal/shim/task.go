@@ -0,0 +1,210 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	eventstypes "github.com/containerd/containerd/api/events"
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/protobuf"
+	ptypes "github.com/containerd/containerd/protobuf/types"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/typeurl/v2"
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/vm"
+	"github.com/sirupsen/logrus"
+)
+
+func (s *service) Kill(ctx context.Context, r *taskAPI.KillRequest) (*ptypes.Empty, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if p.hasExited() {
+		return nil, fmt.Errorf("process already finished: %w", errdefs.ErrNotFound)
+	}
+	sig := syscall.Signal(r.Signal)
+
+	// Before start the workload is held in init, and a paused guest can't
+	// run the agent; either way SIGKILL tears the VM down instead.
+	status := s.status()
+	p.mu.Lock()
+	started := p.started
+	p.mu.Unlock()
+	if !started || status == container.Paused {
+		if sig != syscall.SIGKILL || r.ExecID != "" {
+			return nil, fmt.Errorf("task %s cannot receive signal %d while %s: %w", s.id, sig, status, errdefs.ErrFailedPrecondition)
+		}
+		s.machine.StopVMM()
+		return &ptypes.Empty{}, nil
+	}
+
+	req := &agent.Request{Type: agent.RequestSignal, Signal: int(sig), All: r.All}
+	if r.ExecID != "" {
+		req.PID = p.pid
+	}
+	conn, _, err := vm.AgentRequest(s.ctr, req)
+	if err != nil {
+		// An unresponsive guest can still be killed from the outside
+		if sig == syscall.SIGKILL && r.ExecID == "" {
+			logrus.Warnf("task %s: signal via agent failed, stopping VM: %v", s.id, err)
+			s.machine.StopVMM()
+			return &ptypes.Empty{}, nil
+		}
+		return nil, fmt.Errorf("signal task %s: %w", s.id, err)
+	}
+	conn.Close()
+	return &ptypes.Empty{}, nil
+}
+
+func (s *service) Pids(ctx context.Context, r *taskAPI.PidsRequest) (*taskAPI.PidsResponse, error) {
+	if _, err := s.process(""); err != nil {
+		return nil, err
+	}
+	if status := s.status(); status != container.Running {
+		return nil, fmt.Errorf("task %s is %s: %w", s.id, status, errdefs.ErrFailedPrecondition)
+	}
+	// Callers look these up on the host, so they are the VMM's rather
+	// than the guest's
+	var processes []*task.ProcessInfo
+	for _, pid := range s.ctr.HostPIDs() {
+		processes = append(processes, &task.ProcessInfo{Pid: uint32(pid)})
+	}
+	return &taskAPI.PidsResponse{Processes: processes}, nil
+}
+
+// Stats reports the VM in the shape of cgroup v2 metrics, which is what
+// containerd clients know how to display. CPU is the VMM's host usage;
+// memory and pids come from the guest.
+func (s *service) Stats(ctx context.Context, r *taskAPI.StatsRequest) (*taskAPI.StatsResponse, error) {
+	if _, err := s.process(""); err != nil {
+		return nil, err
+	}
+	ctr := s.ctr
+	m, err := vm.ReadMetrics(ctr)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := &stats.Metrics{
+		CPU:    &stats.CPUStat{},
+		Memory: &stats.MemoryStat{},
+		Pids:   &stats.PidsStat{},
+		Io: &stats.IOStat{Usage: []*stats.IOEntry{{
+			Major:  vm.VirtioBlkMajor,
+			Rbytes: m.BlockReadBytes,
+			Wbytes: m.BlockWriteBytes,
+			Rios:   m.BlockReadCount,
+			Wios:   m.BlockWriteCount,
+		}}},
+	}
+	if user, system, rss, err := vm.ProcessUsage(ctr.PID); err == nil {
+		metrics.CPU.UserUsec = user / 1000
+		metrics.CPU.SystemUsec = system / 1000
+		metrics.CPU.UsageUsec = (user + system) / 1000
+		metrics.Memory.Usage = rss
+	}
+	limitMiB := ctr.MemoryMiB
+	if bs, err := vm.BalloonStats(ctr); err == nil {
+		if bs.ActualMib != nil {
+			limitMiB -= *bs.ActualMib
+		}
+		metrics.Memory.Usage = uint64(bs.TotalMemory - bs.FreeMemory)
+		metrics.Memory.File = uint64(bs.DiskCaches)
+		metrics.Memory.Pgfault = uint64(bs.MinorFaults + bs.MajorFaults)
+		metrics.Memory.Pgmajfault = uint64(bs.MajorFaults)
+	}
+	if limitMiB > 0 {
+		metrics.Memory.UsageLimit = uint64(limitMiB) << 20
+	}
+	if s.status() == container.Running {
+		if conn, resp, err := vm.AgentRequest(ctr, &agent.Request{Type: agent.RequestStats}); err == nil {
+			conn.Close()
+			if resp.Stats != nil {
+				metrics.Pids.Current = uint64(resp.Stats.Pids)
+				metrics.MemoryEvents = &stats.MemoryEvents{OomKill: resp.Stats.OOMKills}
+			}
+		}
+	}
+
+	data, err := typeurl.MarshalAny(metrics)
+	if err != nil {
+		return nil, err
+	}
+	return &taskAPI.StatsResponse{Stats: protobuf.FromAny(data)}, nil
+}
+
+func (s *service) Pause(ctx context.Context, r *taskAPI.PauseRequest) (*ptypes.Empty, error) {
+	if err := s.setPaused(true); err != nil {
+		return nil, err
+	}
+	s.publish(runtime.TaskPausedEventTopic, &eventstypes.TaskPaused{ContainerID: s.id})
+	return &ptypes.Empty{}, nil
+}
+
+func (s *service) Resume(ctx context.Context, r *taskAPI.ResumeRequest) (*ptypes.Empty, error) {
+	if err := s.setPaused(false); err != nil {
+		return nil, err
+	}
+	s.publish(runtime.TaskResumedEventTopic, &eventstypes.TaskResumed{ContainerID: s.id})
+	return &ptypes.Empty{}, nil
+}
+
+// setPaused freezes or thaws the whole VM.
+func (s *service) setPaused(pause bool) error {
+	if _, err := s.process(""); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, to, apply := container.Running, container.Paused, vm.Pause
+	if !pause {
+		from, to, apply = container.Paused, container.Running, vm.Resume
+	}
+	if status := s.ctr.EffectiveStatus(); status != from {
+		return fmt.Errorf("task %s is %s: %w", s.id, status, errdefs.ErrFailedPrecondition)
+	}
+	if err := apply(s.ctr); err != nil {
+		return err
+	}
+	if err := s.ctr.Transition(to); err != nil {
+		return err
+	}
+	return s.ctr.Save()
+}
+
+func (s *service) ResizePty(ctx context.Context, r *taskAPI.ResizePtyRequest) (*ptypes.Empty, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.resizeTerminal(uint16(r.Height), uint16(r.Width)); err != nil {
+		return nil, err
+	}
+	return &ptypes.Empty{}, nil
+}
+
+func (s *service) CloseIO(ctx context.Context, r *taskAPI.CloseIORequest) (*ptypes.Empty, error) {
+	p, err := s.process(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if r.Stdin {
+		p.closeStdin()
+	}
+	return &ptypes.Empty{}, nil
+}
+
+func (s *service) Update(ctx context.Context, r *taskAPI.UpdateTaskRequest) (*ptypes.Empty, error) {
+	return nil, fmt.Errorf("update: %w", errdefs.ErrNotImplemented)
+}
+
+func (s *service) Checkpoint(ctx context.Context, r *taskAPI.CheckpointTaskRequest) (*ptypes.Empty, error) {
+	return nil, fmt.Errorf("checkpoint: %w", errdefs.ErrNotImplemented)
+}
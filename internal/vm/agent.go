@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+)
+
+// agentDialTimeout bounds how long we wait for the guest agent to accept a
+// connection. A freshly booted VM may still be starting its kernel.
+const agentDialTimeout = 10 * time.Second
+
+// DialAgent connects to the dock-fire-init agent inside the container's VM.
+// Firecracker exposes guest vsock ports through a host Unix socket: the host
+// connects, writes "CONNECT <port>", and gets "OK <port>" back once the guest
+// accepts. Until the agent is listening Firecracker just closes the socket,
+// so keep retrying until the timeout.
+func DialAgent(ctr *container.Container) (net.Conn, error) {
+	if ctr.VsockPath == "" {
+		return nil, fmt.Errorf("container %q has no agent socket", ctr.ID)
+	}
+
+	deadline := time.Now().Add(agentDialTimeout)
+	for {
+		conn, err := dialVsock(ctr.VsockPath, agent.Port)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("dial agent: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func dialVsock(udsPath string, port uint32) (net.Conn, error) {
+	conn, err := net.Dial("unix", udsPath)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Read the acknowledgement a byte at a time so nothing the guest sends
+	// after it is swallowed by a buffered reader.
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 32 {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	if !strings.HasPrefix(string(line), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected vsock handshake reply %q", line)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// AgentRequest sends req to the guest agent and waits for its response.
+// The connection is returned open so callers can exchange follow-up frames;
+// it is closed if the agent rejects the request.
+func AgentRequest(ctr *container.Container, req *agent.Request) (net.Conn, *agent.Response, error) {
+	conn, err := DialAgent(ctr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := agent.WriteJSON(conn, agent.FrameMessage, req); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("send %s request: %w", req.Type, err)
+	}
+	var resp agent.Response
+	if err := agent.ReadMessage(conn, &resp); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read %s response: %w", req.Type, err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return conn, &resp, nil
+}
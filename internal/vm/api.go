@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/sirupsen/logrus"
+)
+
+// apiTimeout bounds a single call to the Firecracker API socket.
+const apiTimeout = 5 * time.Second
+
+// apiClient returns a client for the running VMM's API socket.
+func apiClient(ctr *container.Container) (*firecracker.Client, error) {
+	if ctr.SocketPath == "" {
+		return nil, fmt.Errorf("container %q has no API socket", ctr.ID)
+	}
+	return firecracker.NewClient(ctr.SocketPath, logrus.NewEntry(logrus.StandardLogger()), false), nil
+}
+
+// apiPut sends body to path on the API socket. It is for requests whose
+// fields the SDK's models don't have.
+func apiPut(ctx context.Context, socketPath, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Pause freezes the VM's vCPUs. Guest memory and devices stay as they are.
+func Pause(ctr *container.Container) error {
+	return setVMState(ctr, models.VMStatePaused)
+}
+
+// Resume restarts the vCPUs of a paused VM.
+func Resume(ctr *container.Container) error {
+	return setVMState(ctr, models.VMStateResumed)
+}
+
+func setVMState(ctr *container.Container, state string) error {
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	if _, err := client.PatchVM(ctx, &models.VM{State: firecracker.String(state)}); err != nil {
+		return fmt.Errorf("set VM state %s: %w", state, err)
+	}
+	return nil
+}
+
+// IDs the SDK gives the root drive and the container's network interface.
+const (
+	rootDriveID = "root_drive"
+	netIfaceID  = "1"
+)
+
+// SetBalloon inflates or deflates the balloon to amountMiB, taking that much
+// memory away from the guest.
+func SetBalloon(ctr *container.Container, amountMiB int64) error {
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	if _, err := client.PatchBalloon(ctx, &models.BalloonUpdate{AmountMib: firecracker.Int64(amountMiB)}); err != nil {
+		return fmt.Errorf("set balloon to %d MiB: %w", amountMiB, err)
+	}
+	return nil
+}
+
+// SetDiskRateLimit limits the root drive to bps bytes and iops operations
+// per second. Zero removes a limit.
+func SetDiskRateLimit(ctr *container.Container, bps, iops int64) error {
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	limiter := rateLimiter(bps, iops)
+	if _, err := client.PatchGuestDriveByID(ctx, rootDriveID, "", func(p *ops.PatchGuestDriveByIDParams) {
+		p.Body.RateLimiter = limiter
+	}); err != nil {
+		return fmt.Errorf("set drive rate limit: %w", err)
+	}
+	return nil
+}
+
+// SetNetRateLimit limits the network interface to rxBps and txBps bytes per
+// second. Zero removes a limit.
+func SetNetRateLimit(ctr *container.Container, rxBps, txBps int64) error {
+	if ctr.TapDevice == "" {
+		return fmt.Errorf("container %q has no network interface", ctr.ID)
+	}
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	if _, err := client.PatchGuestNetworkInterfaceByID(ctx, netIfaceID, &models.PartialNetworkInterface{
+		IfaceID:       firecracker.String(netIfaceID),
+		RxRateLimiter: rateLimiter(rxBps, 0),
+		TxRateLimiter: rateLimiter(txBps, 0),
+	}); err != nil {
+		return fmt.Errorf("set network rate limit: %w", err)
+	}
+	return nil
+}
+
+// rateLimiter builds a limiter that refills every second. Firecracker treats
+// a zero-sized bucket as unlimited, which is how limits are removed.
+func rateLimiter(bytes, ops int64) *models.RateLimiter {
+	bucket := func(n int64) *models.TokenBucket {
+		return &models.TokenBucket{
+			Size:       firecracker.Int64(n),
+			RefillTime: firecracker.Int64(1000),
+		}
+	}
+	return &models.RateLimiter{Bandwidth: bucket(bytes), Ops: bucket(ops)}
+}
@@ -9,6 +9,7 @@ import (
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rorym/dock-fire/internal/agent"
 	"github.com/rorym/dock-fire/internal/container"
 	"github.com/sirupsen/logrus"
 )
@@ -20,6 +21,13 @@ const (
 	DefaultFirecracker  = "firecracker"
 )
 
+// DefaultMemHeadroomMB is added to a container memory limit to size the VM,
+// covering the guest kernel and dock-fire-init.
+const DefaultMemHeadroomMB = 64
+
+// MaxVCPUs is the most vCPUs Firecracker gives a VM.
+const MaxVCPUs = 32
+
 // kernelPath returns the guest kernel path, preferring the DOCK_FIRE_KERNEL_PATH
 // environment variable over the compiled-in default.
 func kernelPath() string {
@@ -30,7 +38,8 @@ func kernelPath() string {
 }
 
 // vcpuCount returns the number of vCPUs for the VM.
-// Priority: annotation "dock-fire/vcpus" > env var DOCK_FIRE_VCPUS > DefaultVCPUs.
+// Priority: annotation "dock-fire/vcpus" > CPU quota/period from the spec
+// (docker run --cpus) > env var DOCK_FIRE_VCPUS > DefaultVCPUs.
 func vcpuCount(spec *specs.Spec) int64 {
 	if spec.Annotations != nil {
 		if v, ok := spec.Annotations["dock-fire/vcpus"]; ok {
@@ -40,6 +49,9 @@ func vcpuCount(spec *specs.Spec) int64 {
 			logrus.Warnf("ignoring invalid dock-fire/vcpus annotation %q", v)
 		}
 	}
+	if n := specVCPUs(spec); n > 0 {
+		return n
+	}
 	if v := os.Getenv("DOCK_FIRE_VCPUS"); v != "" {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
 			return n
@@ -49,25 +61,80 @@ func vcpuCount(spec *specs.Spec) int64 {
 	return DefaultVCPUs
 }
 
-// memSizeMB returns the memory size in MiB for the VM.
-// Priority: annotation "dock-fire/memory" > env var DOCK_FIRE_MEMORY > DefaultMemMB.
+// specVCPUs returns the vCPUs needed to cover the spec's CPU quota, rounded
+// up, or 0 if there is no quota.
+func specVCPUs(spec *specs.Spec) int64 {
+	if spec.Linux == nil || spec.Linux.Resources == nil || spec.Linux.Resources.CPU == nil {
+		return 0
+	}
+	cpu := spec.Linux.Resources.CPU
+	if cpu.Quota == nil || *cpu.Quota <= 0 {
+		return 0
+	}
+	period := uint64(100000) // the kernel's default CFS period
+	if cpu.Period != nil && *cpu.Period > 0 {
+		period = *cpu.Period
+	}
+	n := int64((uint64(*cpu.Quota) + period - 1) / period)
+	return min(n, MaxVCPUs)
+}
+
+// memSizeMB returns the memory size in MiB for the VM, and the part of it
+// that is headroom on top of the spec's memory limit.
+// Priority: annotation "dock-fire/memory" > memory limit from the spec
+// (docker run --memory) plus headroom > env var DOCK_FIRE_MEMORY > DefaultMemMB.
 // Accepts plain MiB ("256"), megabytes ("256M"), or gigabytes ("1G").
-func memSizeMB(spec *specs.Spec) int64 {
+func memSizeMB(spec *specs.Spec) (size, headroom int64) {
 	if spec.Annotations != nil {
 		if v, ok := spec.Annotations["dock-fire/memory"]; ok {
 			if n, err := parseMemSize(v); err == nil {
-				return n
+				return n, 0
 			}
 			logrus.Warnf("ignoring invalid dock-fire/memory annotation %q", v)
 		}
 	}
+	if spec.Linux != nil && spec.Linux.Resources != nil && spec.Linux.Resources.Memory != nil {
+		if limit := spec.Linux.Resources.Memory.Limit; limit != nil && *limit > 0 {
+			// The limit is for the workload; the guest kernel and init
+			// need room on top of it.
+			n := (*limit + 1<<20 - 1) >> 20
+			h := memHeadroomMB(spec)
+			return n + h, h
+		}
+	}
 	if v := os.Getenv("DOCK_FIRE_MEMORY"); v != "" {
 		if n, err := parseMemSize(v); err == nil {
-			return n
+			return n, 0
 		}
 		logrus.Warnf("ignoring invalid DOCK_FIRE_MEMORY=%q", v)
 	}
-	return DefaultMemMB
+	return DefaultMemMB, 0
+}
+
+// memHeadroomMB returns the memory added to a spec memory limit for the
+// guest itself.
+// Priority: annotation "dock-fire/memory-headroom" > env var
+// DOCK_FIRE_MEMORY_HEADROOM > DefaultMemHeadroomMB.
+func memHeadroomMB(spec *specs.Spec) int64 {
+	parse := func(v string) (int64, error) {
+		if strings.TrimSpace(v) == "0" {
+			return 0, nil
+		}
+		return parseMemSize(v)
+	}
+	if v, ok := spec.Annotations["dock-fire/memory-headroom"]; ok {
+		if n, err := parse(v); err == nil {
+			return n
+		}
+		logrus.Warnf("ignoring invalid dock-fire/memory-headroom annotation %q", v)
+	}
+	if v := os.Getenv("DOCK_FIRE_MEMORY_HEADROOM"); v != "" {
+		if n, err := parse(v); err == nil {
+			return n
+		}
+		logrus.Warnf("ignoring invalid DOCK_FIRE_MEMORY_HEADROOM=%q", v)
+	}
+	return DefaultMemHeadroomMB
 }
 
 // parseMemSize parses a memory size string into MiB.
@@ -100,23 +167,58 @@ func parseMemSize(s string) (int64, error) {
 	}
 }
 
+// SocketPaths returns the Firecracker API socket and the host side of the
+// agent vsock for a container. They are kept short to stay under the
+// 108-char Unix socket limit: Docker sets root to long paths like
+// /var/run/docker/runtime-runc/moby combined with 64-char container IDs.
+func SocketPaths(id string) (api, vsock string) {
+	short := id[:min(len(id), 12)]
+	return fmt.Sprintf("/tmp/fc-%s.sock", short), fmt.Sprintf("/tmp/fc-%s.vsock", short)
+}
+
 // BuildConfig creates a Firecracker VM config from container state.
 func BuildConfig(ctr *container.Container, bootArgs string, spec *specs.Spec) firecracker.Config {
-	// Use a short socket path to stay under the 108-char Unix socket limit.
-	// Docker sets root to long paths like /var/run/docker/runtime-runc/moby
-	// combined with 64-char container IDs.
-	socketPath := fmt.Sprintf("/tmp/fc-%s.sock", ctr.ID[:min(len(ctr.ID), 12)])
+	socketPath, vsockPath := SocketPaths(ctr.ID)
 	ctr.SocketPath = socketPath
+	ctr.VsockPath = vsockPath
+
+	ctr.VCPUs = vcpuCount(spec)
+	ctr.MemoryMiB, ctr.MemoryHeadroomMiB = memSizeMB(spec)
+
+	// The guest numbers the volumes' drives from /dev/vdb in this order
+	drives := firecracker.NewDrivesBuilder(ctr.ImagePath)
+	if spec.Root != nil && spec.Root.Readonly {
+		// Firecracker then boots the guest with its root mounted ro
+		drives = drives.WithRootDrive(ctr.ImagePath, firecracker.WithReadOnly(true))
+	}
+	for _, v := range ctr.Volumes {
+		drives = drives.AddDrive(v.DrivePath(), v.ReadOnly)
+	}
 
 	cfg := firecracker.Config{
 		SocketPath:      socketPath,
 		KernelImagePath: kernelPath(),
 		KernelArgs:      bootArgs,
-		Drives:          firecracker.NewDrivesBuilder(ctr.ImagePath).Build(),
+		MetricsPath:     MetricsPath(ctr),
+		Drives:          drives.Build(),
 		MachineCfg: models.MachineConfiguration{
-			VcpuCount:  firecracker.Int64(vcpuCount(spec)),
-			MemSizeMib: firecracker.Int64(memSizeMB(spec)),
+			VcpuCount:  firecracker.Int64(ctr.VCPUs),
+			MemSizeMib: firecracker.Int64(ctr.MemoryMiB),
+			// Needed for diff snapshots on repeat checkpoints
+			TrackDirtyPages: true,
+		},
+		// The guest agent in dock-fire-init listens on this device for
+		// exec requests from the host.
+		VsockDevices: []firecracker.VsockDevice{
+			{
+				ID:   "agent",
+				Path: vsockPath,
+				CID:  agent.GuestCID,
+			},
 		},
+		// Container signals go through the guest agent. Left nil, the SDK
+		// would forward the runtime's own SIGINT/SIGTERM to the VMM.
+		ForwardSignals: []os.Signal{},
 	}
 
 	// Add network interface if networking is configured
@@ -8,8 +8,8 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// openPTY opens a new pseudoterminal pair, returning the master and slave files.
-func openPTY() (master *os.File, slave *os.File, err error) {
+// OpenPTY opens a new pseudoterminal pair, returning the master and slave files.
+func OpenPTY() (master *os.File, slave *os.File, err error) {
 	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
 	if err != nil {
 		return nil, nil, fmt.Errorf("open /dev/ptmx: %w", err)
@@ -41,6 +41,69 @@ func openPTY() (master *os.File, slave *os.File, err error) {
 	return master, slave, nil
 }
 
+// OpenConsole allocates a pseudoterminal, hands the master to the caller of
+// consoleSocket and returns the slave for the runtime to use as stdio.
+func OpenConsole(consoleSocket string) (*os.File, error) {
+	master, slave, err := OpenPTY()
+	if err != nil {
+		return nil, fmt.Errorf("open pty: %w", err)
+	}
+	defer master.Close()
+
+	if err := sendConsoleFd(consoleSocket, master); err != nil {
+		slave.Close()
+		return nil, fmt.Errorf("send console fd: %w", err)
+	}
+	return slave, nil
+}
+
+// IsTerminal reports whether f refers to a terminal.
+func IsTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// MakeRaw puts the terminal f into raw mode so bytes pass through unchanged,
+// returning the previous settings for RestoreTerminal.
+func MakeRaw(f *os.File) (*unix.Termios, error) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("TCGETS: %w", err)
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, fmt.Errorf("TCSETS: %w", err)
+	}
+	return old, nil
+}
+
+// RestoreTerminal reapplies settings saved by MakeRaw.
+func RestoreTerminal(f *os.File, state *unix.Termios) error {
+	return unix.IoctlSetTermios(int(f.Fd()), unix.TCSETS, state)
+}
+
+// TerminalSize returns the window size of the terminal f.
+func TerminalSize(f *os.File) (rows, cols uint16, err error) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ws.Row, ws.Col, nil
+}
+
+// SetTerminalSize sets the window size of the terminal f.
+func SetTerminalSize(f *os.File, rows, cols uint16) error {
+	return unix.IoctlSetWinsize(int(f.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+}
+
 // sendConsoleFd sends the master PTY file descriptor over a Unix socket
 // (SCM_RIGHTS) to the containerd shim, which uses it for terminal I/O.
 func sendConsoleFd(consoleSocket string, master *os.File) error {
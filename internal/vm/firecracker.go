@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/rorym/dock-fire/internal/cgroup"
 	"github.com/rorym/dock-fire/internal/container"
 	"github.com/sirupsen/logrus"
 
@@ -17,106 +18,161 @@ import (
 
 // Start boots a Firecracker VM for the given container.
 func Start(ctr *container.Container, spec *specs.Spec, consoleSocket string) error {
+	stdin, stdout, release, err := consoleIO(ctr, spec, consoleSocket)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = StartWithIO(ctr, spec, stdin, stdout)
+	return err
+}
+
+// StartWithIO boots the VM with its serial console on stdin and stdout, and
+// returns the SDK machine for callers that stay around to manage it.
+func StartWithIO(ctr *container.Container, spec *specs.Spec, stdin io.Reader, stdout io.Writer) (*firecracker.Machine, error) {
 	bootArgs := BuildBootArgs(ctr)
 	cfg := BuildConfig(ctr, bootArgs, spec)
 
 	logrus.Debugf("VM config: kernel=%s rootfs=%s socket=%s", cfg.KernelImagePath, ctr.ImagePath, cfg.SocketPath)
 	logrus.Debugf("boot args: %s", bootArgs)
 
+	return launch(ctr, cfg, stdin, stdout, withBalloon(), withCgroup(ctr, spec))
+}
+
+// consoleIO returns the stdio for the VM's serial console. A terminal
+// workload runs on the console: it gets the slave of a pty handed to
+// consoleSocket, or the runtime's own stdio. Otherwise the workload's stdio
+// goes over vsock and the console, with the guest kernel's messages, is
+// only logged. release drops our copies once the VMM holds them.
+func consoleIO(ctr *container.Container, spec *specs.Spec, consoleSocket string) (io.Reader, io.Writer, func(), error) {
+	if spec.Process == nil || !spec.Process.Terminal {
+		logFile, err := OpenConsoleLog(ctr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, logFile, func() { logFile.Close() }, nil
+	}
+	if consoleSocket == "" {
+		return os.Stdin, os.Stdout, func() {}, nil
+	}
+	slave, err := OpenConsole(consoleSocket)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return slave, slave, func() { slave.Close() }, nil
+}
+
+// balloonStatsInterval is how often, in seconds, the guest balloon driver
+// reports memory statistics.
+const balloonStatsInterval = 1
+
+// withBalloon adds an empty balloon device so update can take memory back
+// from the guest later. It doesn't deflate under pressure: a memory limit
+// should behave like a cgroup limit and OOM inside the guest.
+func withBalloon() firecracker.Opt {
+	return func(m *firecracker.Machine) {
+		m.Handlers.FcInit = m.Handlers.FcInit.Append(
+			firecracker.NewCreateBalloonHandler(0, false, balloonStatsInterval))
+	}
+}
+
+// withCgroup moves the VMM into the container's cgroup as soon as it has
+// started, before guest memory is touched, so all of it is charged there.
+// A cgroup the caller asked for must be set up; failing to set up the
+// default one is only a warning, and the VM runs without host limits.
+func withCgroup(ctr *container.Container, spec *specs.Spec) firecracker.Opt {
+	return func(m *firecracker.Machine) {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.StartVMMHandlerName, firecracker.Handler{
+			Name: "dock-fire.Cgroup",
+			Fn: func(ctx context.Context, m *firecracker.Machine) error {
+				pid, err := m.PID()
+				if err != nil {
+					return fmt.Errorf("get VMM PID: %w", err)
+				}
+				if err := cgroup.Setup(ctr, spec, pid); err != nil {
+					if cgroup.Requested(ctr, spec) {
+						return fmt.Errorf("set up cgroup: %w", err)
+					}
+					logrus.Warnf("container %s: cgroup: %v", ctr.ID, err)
+					cgroup.Remove(ctr)
+					ctr.CgroupPath, ctr.CgroupUnit = "", ""
+				}
+				return nil
+			},
+		})
+	}
+}
+
+// launch starts the Firecracker process for cfg with its serial console on
+// stdin and stdout, and records its PID. opts are applied to the SDK
+// machine, e.g. to load a snapshot instead of booting.
+func launch(ctr *container.Container, cfg firecracker.Config, stdin io.Reader, stdout io.Writer, opts ...firecracker.Opt) (*firecracker.Machine, error) {
 	os.Remove(cfg.SocketPath)
+	os.Remove(ctr.VsockPath)
 
 	stateDir := filepath.Join(ctr.RootDir, ctr.ID)
 
 	stderrPath := filepath.Join(stateDir, "vm-stderr.log")
 	stderrFile, err := os.OpenFile(stderrPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
 	if err != nil {
-		return fmt.Errorf("open stderr log: %w", err)
+		return nil, fmt.Errorf("open stderr log: %w", err)
 	}
+	defer stderrFile.Close()
 
 	logPath := filepath.Join(stateDir, "vm-log.log")
 	logFile, err := os.Create(logPath)
 	if err != nil {
-		stderrFile.Close()
-		return fmt.Errorf("create log file: %w", err)
+		return nil, fmt.Errorf("create log file: %w", err)
 	}
 	logFile.Close()
 
-	var (
-		fcStdin  io.Reader
-		fcStdout io.Writer
-		master   *os.File
-		slave    *os.File
-	)
-
-	if consoleSocket != "" {
-		var err error
-		master, slave, err = openPTY()
-		if err != nil {
-			stderrFile.Close()
-			return fmt.Errorf("open pty: %w", err)
-		}
-
-		if err := sendConsoleFd(consoleSocket, master); err != nil {
-			master.Close()
-			slave.Close()
-			stderrFile.Close()
-			return fmt.Errorf("send console fd: %w", err)
-		}
-		master.Close()
-
-		fcStdin = slave
-		fcStdout = slave
-	} else {
-		fcStdin = os.Stdin
-		fcStdout = os.Stdout
-	}
-
 	ctx := context.Background()
 	cmd := firecracker.VMCommandBuilder{}.
 		WithBin(DefaultFirecracker).
 		WithSocketPath(cfg.SocketPath).
 		AddArgs("--log-path", logPath, "--level", "Error").
-		WithStdin(fcStdin).
-		WithStdout(fcStdout).
+		WithStdin(stdin).
+		WithStdout(stdout).
 		WithStderr(stderrFile).
 		Build(ctx)
 
+	locks, err := lockVolumes(ctr)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(locks)
+	cmd.ExtraFiles = locks
+
 	sdkLogger := logrus.New()
 	sdkLogger.SetOutput(stderrFile)
 	sdkLogger.SetLevel(logrus.WarnLevel)
 
-	machine, err := firecracker.NewMachine(ctx, cfg,
+	machine, err := firecracker.NewMachine(ctx, cfg, append([]firecracker.Opt{
 		firecracker.WithProcessRunner(cmd),
 		firecracker.WithLogger(logrus.NewEntry(sdkLogger)),
-	)
+	}, opts...)...)
 	if err != nil {
-		stderrFile.Close()
-		return fmt.Errorf("create machine: %w", err)
+		return nil, fmt.Errorf("create machine: %w", err)
 	}
 
 	if err := machine.Start(ctx); err != nil {
-		if slave != nil {
-			slave.Close()
+		// The SDK leaves the VMM running if a later handler fails
+		if _, perr := machine.PID(); perr == nil {
+			machine.StopVMM()
 		}
-		stderrFile.Close()
-		return fmt.Errorf("start machine: %w", err)
-	}
-	if slave != nil {
-		slave.Close()
+		return nil, fmt.Errorf("start machine: %w", err)
 	}
 
 	pid, err := machine.PID()
 	if err != nil {
-		stderrFile.Close()
-		return fmt.Errorf("get VMM PID: %w", err)
+		return nil, fmt.Errorf("get VMM PID: %w", err)
 	}
 
 	ctr.PID = pid
 
 	logrus.Debugf("VM started with PID %d", pid)
-
-	stderrFile.Close()
-	return nil
+	return machine, nil
 }
 
 // Stop terminates the Firecracker VMM process.
@@ -142,6 +198,17 @@ func Stop(ctr *container.Container) error {
 	return nil
 }
 
+// OpenConsoleLog opens the log that takes the VM's serial console output
+// when the workload isn't on it.
+func OpenConsoleLog(ctr *container.Container) (*os.File, error) {
+	path := filepath.Join(ctr.RootDir, ctr.ID, "console.log")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open console log: %w", err)
+	}
+	return f, nil
+}
+
 // OutputPath returns the path to the VM stderr log (for debugging).
 func OutputPath(rootDir, id string) string {
 	return filepath.Join(rootDir, id, "vm-stderr.log")
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/rorym/dock-fire/internal/oci"
+	"github.com/sirupsen/logrus"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// RunCreateHooks runs the hooks for the end of create: prestart and
+// createRuntime on the host, then createContainer in the guest.
+func RunCreateHooks(ctr *container.Container, hooks *specs.Hooks) error {
+	if hooks == nil {
+		return nil
+	}
+	state, err := oci.MarshalState(ctr)
+	if err != nil {
+		return err
+	}
+	// prestart is deprecated in favour of createRuntime but still in use
+	if err := oci.RunHooks("prestart", hooks.Prestart, state); err != nil {
+		return err
+	}
+	if err := oci.RunHooks("createRuntime", hooks.CreateRuntime, state); err != nil {
+		return err
+	}
+	return runGuestHooks(ctr, "createContainer", hooks.CreateContainer, state)
+}
+
+// RunStartHooks runs the startContainer hooks in the guest, just before the
+// main process is released.
+func RunStartHooks(ctr *container.Container, hooks *specs.Hooks) error {
+	if hooks == nil {
+		return nil
+	}
+	state, err := oci.MarshalState(ctr)
+	if err != nil {
+		return err
+	}
+	return runGuestHooks(ctr, "startContainer", hooks.StartContainer, state)
+}
+
+// RunPostHooks runs poststart or poststop hooks on the host. A failure
+// there doesn't change the outcome of the operation, so it is only logged.
+func RunPostHooks(ctr *container.Container, kind string, hooks []specs.Hook) {
+	if len(hooks) == 0 {
+		return
+	}
+	state, err := oci.MarshalState(ctr)
+	if err == nil {
+		err = oci.RunHooks(kind, hooks, state)
+	}
+	if err != nil {
+		logrus.Warnf("container %s: %v", ctr.ID, err)
+	}
+}
+
+// runGuestHooks runs container-side hooks inside the VM through the agent,
+// so their paths and effects are those of the guest.
+func runGuestHooks(ctr *container.Container, kind string, hooks []specs.Hook, state []byte) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	conn, _, err := AgentRequest(ctr, &agent.Request{Type: agent.RequestHooks, Hook: kind, Hooks: hooks, State: state})
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
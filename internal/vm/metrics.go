@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/rorym/dock-fire/internal/container"
+	"golang.org/x/sys/unix"
+)
+
+// Metrics are cumulative counters for a VM. Firecracker's own metrics only
+// report what changed since the previous flush, so they are summed into a
+// totals file in the state directory as they are read.
+type Metrics struct {
+	VcpuExits       uint64 `json:"vcpuExits"`
+	BlockReadBytes  uint64 `json:"blockReadBytes"`
+	BlockWriteBytes uint64 `json:"blockWriteBytes"`
+	BlockReadCount  uint64 `json:"blockReadCount"`
+	BlockWriteCount uint64 `json:"blockWriteCount"`
+	NetRxBytes      uint64 `json:"netRxBytes"`
+	NetTxBytes      uint64 `json:"netTxBytes"`
+	NetRxPackets    uint64 `json:"netRxPackets"`
+	NetTxPackets    uint64 `json:"netTxPackets"`
+}
+
+// fcMetrics is the subset of a Firecracker metrics line we use. The block
+// and net sections aggregate over all devices.
+type fcMetrics struct {
+	Vcpu  map[string]uint64 `json:"vcpu"`
+	Block map[string]uint64 `json:"block"`
+	Net   map[string]uint64 `json:"net"`
+}
+
+func (m *Metrics) add(fc *fcMetrics) {
+	for k, v := range fc.Vcpu {
+		if strings.HasPrefix(k, "exit_") {
+			m.VcpuExits += v
+		}
+	}
+	m.BlockReadBytes += fc.Block["read_bytes"]
+	m.BlockWriteBytes += fc.Block["write_bytes"]
+	m.BlockReadCount += fc.Block["read_count"]
+	m.BlockWriteCount += fc.Block["write_count"]
+	m.NetRxBytes += fc.Net["rx_bytes_count"]
+	m.NetTxBytes += fc.Net["tx_bytes_count"]
+	m.NetRxPackets += fc.Net["rx_packets_count"]
+	m.NetTxPackets += fc.Net["tx_packets_count"]
+}
+
+// VirtioBlkMajor is the block major the guest gives the root drive, which
+// the block counters in Metrics are reported under.
+const VirtioBlkMajor = 254
+
+// MetricsPath is where Firecracker writes its metrics for ctr.
+func MetricsPath(ctr *container.Container) string {
+	return filepath.Join(ctr.RootDir, ctr.ID, "vm-metrics.log")
+}
+
+func metricsTotalsPath(ctr *container.Container) string {
+	return filepath.Join(ctr.RootDir, ctr.ID, "vm-metrics.json")
+}
+
+// metricsTotals is what the totals file holds: the sums, and how far into
+// Firecracker's metrics file they go.
+type metricsTotals struct {
+	Metrics
+	Offset int64 `json:"offset"`
+}
+
+// ReadMetrics flushes Firecracker's metrics and returns the running totals.
+// Firecracker appends to the metrics file at any time, so it is never
+// truncated under it: reading resumes at the offset the last read stopped
+// at, and the space before that is freed by punching a hole.
+func ReadMetrics(ctr *container.Container) (*Metrics, error) {
+	// Serialise readers so no flush is counted twice
+	totalsFile, err := os.OpenFile(metricsTotalsPath(ctr), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open metrics totals: %w", err)
+	}
+	defer totalsFile.Close()
+	if err := unix.Flock(int(totalsFile.Fd()), unix.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("lock metrics totals: %w", err)
+	}
+
+	var totals metricsTotals
+	if data, err := os.ReadFile(totalsFile.Name()); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &totals); err != nil {
+			return nil, fmt.Errorf("parse metrics totals: %w", err)
+		}
+	}
+
+	if err := flushMetrics(ctr); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(MetricsPath(ctr), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open metrics: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat metrics: %w", err)
+	}
+	if fi.Size() < totals.Offset {
+		// A new VMM, e.g. after restore, started the file again
+		totals.Offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, totals.Offset, fi.Size()-totals.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("read metrics: %w", err)
+	}
+	// Only whole lines are counted; the rest is read next time
+	end := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		// Files written before offsets were kept can start with a hole
+		line = bytes.Trim(line, "\x00 \r")
+		if len(line) == 0 {
+			continue
+		}
+		var fc fcMetrics
+		if err := json.Unmarshal(line, &fc); err != nil {
+			continue
+		}
+		totals.add(&fc)
+	}
+	totals.Offset += int64(end)
+	// Not every filesystem can punch holes; the file then just grows
+	unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, totals.Offset)
+
+	out, err := json.Marshal(&totals)
+	if err != nil {
+		return nil, err
+	}
+	if err := totalsFile.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := totalsFile.WriteAt(out, 0); err != nil {
+		return nil, fmt.Errorf("write metrics totals: %w", err)
+	}
+	return &totals.Metrics, nil
+}
+
+func flushMetrics(ctr *container.Container) error {
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	if _, err := client.CreateSyncAction(ctx, &models.InstanceActionInfo{
+		ActionType: firecracker.String(models.InstanceActionInfoActionTypeFlushMetrics),
+	}); err != nil {
+		return fmt.Errorf("flush metrics: %w", err)
+	}
+	return nil
+}
+
+// BalloonStats returns the guest memory statistics reported through the
+// balloon device.
+func BalloonStats(ctr *container.Container) (*models.BalloonStats, error) {
+	client, err := apiClient(ctr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	resp, err := client.DescribeBalloonStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("balloon stats: %w", err)
+	}
+	return resp.Payload, nil
+}
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat.
+const clockTicks = 100
+
+// ProcessUsage returns a host process's user and system CPU time in
+// nanoseconds and its resident set size in bytes.
+func ProcessUsage(pid int) (user, system, rss uint64, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// Fields after the command name, which may contain spaces
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// utime and stime are fields 14 and 15 of the full line; rss is 24
+	if len(fields) < 22 {
+		return 0, 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	pages, _ := strconv.ParseUint(fields[21], 10, 64)
+
+	tick := uint64(time.Second) / clockTicks
+	return utime * tick, stime * tick, pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,201 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/rorym/dock-fire/internal/agent"
+	"github.com/rorym/dock-fire/internal/container"
+	"github.com/sirupsen/logrus"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// snapshotTimeout bounds writing a snapshot, which copies all of guest
+// memory for a full snapshot.
+const snapshotTimeout = 5 * time.Minute
+
+// Snapshot writes the paused VM's memory and device state. A diff snapshot
+// only contains the pages dirtied since the previous snapshot, as a sparse
+// file the size of guest memory.
+func Snapshot(ctr *container.Container, memPath, statePath string, diff bool) error {
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	snapshotType := models.SnapshotCreateParamsSnapshotTypeFull
+	if diff {
+		snapshotType = models.SnapshotCreateParamsSnapshotTypeDiff
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	if _, err := client.CreateSnapshot(ctx, &models.SnapshotCreateParams{
+		MemFilePath:  firecracker.String(memPath),
+		SnapshotPath: firecracker.String(statePath),
+		SnapshotType: snapshotType,
+	}); err != nil {
+		return fmt.Errorf("create %s snapshot: %w", snapshotType, err)
+	}
+	return nil
+}
+
+// SnapshotPaths are the host resources a snapshot's VM was using.
+// Firecracker reopens them when the snapshot is loaded, so Restore points
+// each one that differs at ctr's own.
+type SnapshotPaths struct {
+	ImagePath string
+	VsockPath string
+	TapDevice string
+}
+
+// snapshotLoad is Firecracker's snapshot load request, with the overrides
+// the SDK's model lacks.
+type snapshotLoad struct {
+	SnapshotPath        string            `json:"snapshot_path"`
+	MemFilePath         string            `json:"mem_file_path"`
+	EnableDiffSnapshots bool              `json:"enable_diff_snapshots,omitempty"`
+	NetworkOverrides    []networkOverride `json:"network_overrides,omitempty"`
+	VsockOverride       *vsockOverride    `json:"vsock_override,omitempty"`
+}
+
+type networkOverride struct {
+	IfaceID     string `json:"iface_id"`
+	HostDevName string `json:"host_dev_name"`
+}
+
+type vsockOverride struct {
+	UDSPath string `json:"uds_path"`
+}
+
+// Restore starts a new VMM for ctr from a snapshot taken of a VM that used
+// from, and resumes it on ctr's TAP, vsock and root drive.
+func Restore(ctr *container.Container, spec *specs.Spec, consoleSocket, memPath, statePath string, from SnapshotPaths) error {
+	cfg := BuildConfig(ctr, BuildBootArgs(ctr), spec)
+	// The vsock device comes back with the rest of the snapshot state;
+	// Firecracker refuses new devices once it is loaded.
+	cfg.VsockDevices = nil
+
+	logrus.Debugf("restoring VM from snapshot: mem=%s state=%s socket=%s", memPath, statePath, cfg.SocketPath)
+
+	stdin, stdout, release, err := consoleIO(ctr, spec, consoleSocket)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = launch(ctr, cfg, stdin, stdout, firecracker.WithSnapshot(memPath, statePath,
+		func(s *firecracker.SnapshotConfig) {
+			s.EnableDiffSnapshots = true
+		}), withSnapshotOverrides(ctr, from), withCgroup(ctr, spec))
+	return err
+}
+
+// SetGuestAddress moves the guest's interface onto ctr's subnet, for a VM
+// restored from a snapshot taken on another one.
+func SetGuestAddress(ctr *container.Container) error {
+	conn, _, err := AgentRequest(ctr, &agent.Request{
+		Type:    agent.RequestNetwork,
+		Address: ctr.GuestIP + "/30",
+		Gateway: ctr.HostIP,
+	})
+	if err != nil {
+		return fmt.Errorf("set guest address: %w", err)
+	}
+	conn.Close()
+	return nil
+}
+
+// withSnapshotOverrides replaces the SDK's snapshot load with one that
+// moves the VM onto ctr's resources before resuming it.
+func withSnapshotOverrides(ctr *container.Container, from SnapshotPaths) firecracker.Opt {
+	return func(m *firecracker.Machine) {
+		m.Handlers.FcInit = m.Handlers.FcInit.Swap(firecracker.Handler{
+			Name: firecracker.LoadSnapshotHandlerName,
+			Fn: func(ctx context.Context, m *firecracker.Machine) error {
+				return loadSnapshot(ctx, ctr, m.Cfg.Snapshot, from)
+			},
+		})
+	}
+}
+
+// loadSnapshot loads the snapshot paused, with the TAP and vsock socket
+// overridden where ctr's differ, re-points the root drive and resumes.
+func loadSnapshot(ctx context.Context, ctr *container.Container, snap firecracker.SnapshotConfig, from SnapshotPaths) error {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	load := snapshotLoad{
+		SnapshotPath:        snap.SnapshotPath,
+		MemFilePath:         snap.MemFilePath,
+		EnableDiffSnapshots: snap.EnableDiffSnapshots,
+	}
+	if from.TapDevice != "" && from.TapDevice != ctr.TapDevice {
+		load.NetworkOverrides = []networkOverride{{IfaceID: netIfaceID, HostDevName: ctr.TapDevice}}
+	}
+	if from.VsockPath != ctr.VsockPath {
+		load.VsockOverride = &vsockOverride{UDSPath: ctr.VsockPath}
+	}
+	moved := from.ImagePath != ctr.ImagePath
+	if moved {
+		// The drive is reopened from its recorded path while loading and
+		// only re-pointed afterwards
+		cleanup, err := stageDrive(from.ImagePath, ctr.ImagePath)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+	if err := apiPut(ctx, ctr.SocketPath, "/snapshot/load", load); err != nil {
+		return fmt.Errorf("load snapshot: %w", err)
+	}
+
+	client, err := apiClient(ctr)
+	if err != nil {
+		return err
+	}
+	if moved {
+		if _, err := client.PatchGuestDriveByID(ctx, rootDriveID, ctr.ImagePath); err != nil {
+			return fmt.Errorf("re-point root drive: %w", err)
+		}
+	}
+	if _, err := client.PatchVM(ctx, &models.VM{State: firecracker.String(models.VMStateResumed)}); err != nil {
+		return fmt.Errorf("resume restored VM: %w", err)
+	}
+	return nil
+}
+
+// stageDrive makes sure there is a file at path for Firecracker to open,
+// linking it to image if nothing is there. The returned function removes
+// whatever was created.
+func stageDrive(path, image string) (func(), error) {
+	if _, err := os.Lstat(path); err == nil {
+		return func() {}, nil
+	}
+	var created []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("stage root drive: %w", err)
+	}
+	cleanup := func() {
+		os.Remove(path)
+		for _, dir := range created {
+			os.Remove(dir)
+		}
+	}
+	if err := os.Symlink(image, path); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("stage root drive: %w", err)
+	}
+	return cleanup, nil
+}
@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/rorym/dock-fire/internal/container"
+)
+
+// lockVolumes takes the locks of the container's named volumes: shared to
+// attach one read-only, exclusive to attach it read-write. The files are
+// passed on to the VMM, so the locks are held for as long as it runs and
+// released however it exits. The caller closes its copies once the VMM has
+// started.
+func lockVolumes(ctr *container.Container) ([]*os.File, error) {
+	var locks []*os.File
+	for _, v := range ctr.Volumes {
+		if v.Lock == "" {
+			continue
+		}
+		f, err := lockVolume(ctr.ID, v)
+		if err != nil {
+			closeFiles(locks)
+			return nil, err
+		}
+		locks = append(locks, f)
+	}
+	return locks, nil
+}
+
+func lockVolume(id string, v container.Volume) (*os.File, error) {
+	f, err := os.OpenFile(v.Lock, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open volume lock: %w", err)
+	}
+	how := syscall.LOCK_EX
+	if v.ReadOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if v.ReadOnly {
+				// Only a writer keeps a reader out
+				return nil, fmt.Errorf("volume %s is attached read-write to another VM%s", v.Name, lockHolder(v.Lock))
+			}
+			return nil, fmt.Errorf("volume %s is in use by another VM", v.Name)
+		}
+		return nil, fmt.Errorf("lock volume %s: %w", v.Name, err)
+	}
+	// Only a writer is alone in holding the lock, so only it records itself
+	if !v.ReadOnly {
+		f.Truncate(0)
+		f.WriteAt([]byte(id), 0)
+	}
+	return f, nil
+}
+
+// lockHolder names the container holding a volume read-write, if known.
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (container %s)", strings.TrimSpace(string(data)))
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -130,6 +130,13 @@ create_kernel_config() {
     ./scripts/config --enable CONFIG_NET
     ./scripts/config --enable CONFIG_INET
 
+    # vsock (host <-> dock-fire-init agent channel)
+    ./scripts/config --enable CONFIG_VSOCKETS
+    ./scripts/config --enable CONFIG_VIRTIO_VSOCKETS
+
+    # Memory balloon (dock-fire update --memory)
+    ./scripts/config --enable CONFIG_VIRTIO_BALLOON
+
     # Overlay filesystem (required for Docker)
     ./scripts/config --enable CONFIG_OVERLAY_FS
 